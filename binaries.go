@@ -0,0 +1,98 @@
+// binaries.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Binary Resolution ---
+
+// binaryCheckTimeout bounds how long startup waits for the remote lookup.
+const binaryCheckTimeout = 30 * time.Second
+
+// resolveBinaries checks that zopen and zopen-generate can be found on every
+// target and logs the paths it resolved to stderr. A path given explicitly
+// with --zopen-path or --zopen-generate-path must resolve, so a typo is caught
+// at startup; a binary that is merely missing from PATH is reported as a
+// warning, since not every workflow needs both tools. Targets are checked
+// concurrently so one slow host does not hold up the others.
+func resolveBinaries(ctx context.Context, config *Config) error {
+	errs := make([]error, len(config.Targets))
+	var wg sync.WaitGroup
+	for i, name := range config.TargetNames() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = resolveTargetBinaries(ctx, config.Targets[name])
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// resolveTargetBinaries checks the binaries of a single target.
+func resolveTargetBinaries(ctx context.Context, target *Target) error {
+	binaries := []struct {
+		name     string // tool name used in messages
+		program  string // program that will be run
+		flagName string // flag that overrides it
+		explicit bool   // whether the flag was given
+	}{
+		{"zopen", target.ZopenBinary(), "--zopen-path", target.ZopenPath != ""},
+		{"zopen-generate", target.ZopenGenerateBinary(), "--zopen-generate-path", target.ZopenGeneratePath != ""},
+	}
+
+	for _, b := range binaries {
+		path, err := resolveBinary(ctx, target, b.program)
+		if _, unreachable := err.(*remoteCheckError); unreachable {
+			// Don't refuse to start just because the host is down right
+			// now; tool calls will report the connection problem.
+			log.Printf("Warning: could not verify binaries on target %s: %v", target.Name, err)
+			return nil
+		}
+		if err != nil {
+			if b.explicit {
+				return fmt.Errorf("target %s: %s %q: %v", target.Name, b.flagName, b.program, err)
+			}
+			log.Printf("Warning: target %s: %s not resolved: %v", target.Name, b.name, err)
+			continue
+		}
+		log.Printf("Target %s: using %s: %s", target.Name, b.name, path)
+	}
+	return nil
+}
+
+// resolveBinary locates program on target, using the same environment tool
+// calls will use.
+func resolveBinary(ctx context.Context, target *Target, program string) (string, error) {
+	if !target.Remote {
+		return exec.LookPath(program)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, binaryCheckTimeout)
+	defer cancel()
+
+	res, err := target.Exec.Run(ctx, Command{Program: "command", Args: []string{"-v", program}})
+	if err != nil {
+		return "", &remoteCheckError{err}
+	}
+	path := strings.TrimSpace(res.Stdout)
+	if res.ExitCode != 0 || path == "" {
+		return "", fmt.Errorf("%s not found on %s", program, res.Host)
+	}
+	return fmt.Sprintf("%s:%s", res.Host, path), nil
+}
+
+// remoteCheckError reports that the remote lookup could not be run at all.
+type remoteCheckError struct {
+	err error
+}
+
+func (e *remoteCheckError) Error() string { return e.err.Error() }
@@ -0,0 +1,218 @@
+// bootstrap.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// --- Remote Environment Bootstrap ---
+
+// Bootstrap settings. A path may follow "profile" or "zopen-config" after a
+// colon, e.g. "zopen-config:/usr/local/zopen/etc/zopen-config".
+const (
+	bootstrapAuto        = "auto"         // zopen-config if found, else ~/.profile
+	bootstrapNone        = "none"         // run commands in the bare SSH environment
+	bootstrapProfile     = "profile"      // source ~/.profile or the given file
+	bootstrapZopenConfig = "zopen-config" // source the detected or given zopen-config
+)
+
+// defaultProfile is the profile sourced by the "profile" bootstrap.
+const defaultProfile = "~/.profile"
+
+// detectZopenConfigScript prints the path of the first readable zopen-config
+// it finds: under $ZOPEN_ROOT, the file the user's ~/.profile sources, or a
+// default install location. It runs without any bootstrap.
+const detectZopenConfigScript = `for f in "${ZOPEN_ROOT:+$ZOPEN_ROOT/etc/zopen-config}" \
+  $(sed -n 's/^[[:space:]]*\.[[:space:]][[:space:]]*\([^[:space:];&|]*zopen-config\)[[:space:]]*$/\1/p' "$HOME/.profile" 2>/dev/null) \
+  "$HOME/zopen/etc/zopen-config" /usr/local/zopen/etc/zopen-config; do
+  case $f in
+    "~/"*) f="$HOME/${f#??}" ;;
+    '$HOME/'*|'${HOME}/'*) f="$HOME/${f#*/}" ;;
+  esac
+  if [ -n "$f" ] && [ -r "$f" ]; then echo "$f"; exit 0; fi
+done
+exit 1`
+
+// normalizeBootstrap validates a bootstrap setting.
+func normalizeBootstrap(setting string) (string, error) {
+	if setting == "" {
+		return bootstrapAuto, nil
+	}
+	kind, path, _ := strings.Cut(setting, ":")
+	switch kind {
+	case bootstrapAuto, bootstrapNone:
+		if path != "" {
+			return "", fmt.Errorf("bootstrap %q does not take a path", kind)
+		}
+	case bootstrapProfile, bootstrapZopenConfig:
+	default:
+		return "", fmt.Errorf("unsupported bootstrap %q (expected auto, none, profile[:path] or zopen-config[:path])", setting)
+	}
+	return setting, nil
+}
+
+// remoteBootstrap resolves a target's bootstrap setting to the shell snippet
+// run before each command, detecting zopen-config on first use. The result is
+// cached; a failed detection is retried on the next command. Commands started
+// while a detection is running wait for its result, but stop waiting when
+// their own context is done.
+type remoteBootstrap struct {
+	setting string
+
+	mu        sync.Mutex
+	resolved  bool
+	script    string
+	detected  string               // zopen-config found by detection, if any
+	resolving *bootstrapResolution // the resolution in progress, if any
+}
+
+// bootstrapResolution is the outcome of one resolution, shared with the
+// commands waiting for it. done is closed once the fields are set.
+type bootstrapResolution struct {
+	done      chan struct{}
+	script    string
+	err       error
+	abandoned bool // the command resolving it ended first; waiters retry
+}
+
+// Script returns the snippet to run before each command. run executes a
+// command on the target without any bootstrap, for detection.
+func (b *remoteBootstrap) Script(ctx context.Context, run func(context.Context, Command) (*CommandResult, error)) (string, error) {
+	for {
+		b.mu.Lock()
+		if b.resolved {
+			script := b.script
+			b.mu.Unlock()
+			return script, nil
+		}
+		if r := b.resolving; r != nil {
+			b.mu.Unlock()
+			select {
+			case <-r.done:
+			case <-ctx.Done():
+				return "", fmt.Errorf("stopped waiting for the bootstrap of %s: %w", b.setting, ctx.Err())
+			}
+			if r.abandoned {
+				continue
+			}
+			return r.script, r.err
+		}
+		r := &bootstrapResolution{done: make(chan struct{})}
+		b.resolving = r
+		b.mu.Unlock()
+
+		script, detected, err := b.resolve(ctx, run)
+
+		b.mu.Lock()
+		b.resolving = nil
+		if err == nil {
+			b.resolved, b.script, b.detected = true, script, detected
+			if os.Getenv("DEBUG") != "" {
+				log.Printf("Bootstrap %s: %s", b.setting, b.describe())
+			}
+		}
+		r.script, r.err = script, err
+		// A detection cut short by this command's context says nothing
+		// about the target, so the commands waiting on it try again.
+		r.abandoned = err != nil && ctx.Err() != nil
+		close(r.done)
+		b.mu.Unlock()
+		return script, err
+	}
+}
+
+// resolve works out the snippet for the setting, running the detection
+// command when the setting calls for one.
+func (b *remoteBootstrap) resolve(ctx context.Context, run func(context.Context, Command) (*CommandResult, error)) (script, detected string, err error) {
+	kind, path, _ := strings.Cut(b.setting, ":")
+	switch {
+	case kind == bootstrapNone:
+		return "", "", nil
+	case kind == bootstrapProfile:
+		if path == "" {
+			path = defaultProfile
+		}
+		return ". " + quoteRemotePath(path), "", nil
+	case kind == bootstrapZopenConfig && path != "":
+		return ". " + quoteRemotePath(path), "", nil
+	}
+
+	res, err := run(ctx, Command{Program: "/bin/sh", Args: []string{"-c", detectZopenConfigScript}})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to detect zopen-config: %w", err)
+	}
+	found := strings.TrimSpace(res.Stdout)
+	switch {
+	case res.ExitCode == 0 && found != "":
+		return ". " + shellQuote(found), found, nil
+	case kind == bootstrapZopenConfig:
+		return "", "", fmt.Errorf("no zopen-config found on %s: set the bootstrap to zopen-config:<path>", res.Host)
+	default:
+		return ". " + quoteRemotePath(defaultProfile), "", nil
+	}
+}
+
+// Describe explains the bootstrap in use, for zopen_env.
+func (b *remoteBootstrap) Describe() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.describe()
+}
+
+func (b *remoteBootstrap) describe() string {
+	switch {
+	case !b.resolved:
+		return fmt.Sprintf("%s (not yet resolved)", b.setting)
+	case b.script == "":
+		return "none"
+	case b.detected != "":
+		return fmt.Sprintf("%s (detected zopen-config, setting %s)", b.script, b.setting)
+	default:
+		return fmt.Sprintf("%s (setting %s)", b.script, b.setting)
+	}
+}
+
+// --- ZopenEnv Tool ---
+
+// envVariables are the variables zopen_env reports.
+var envVariables = []string{
+	"PATH", "LIBPATH", "MANPATH", "ZOPEN_ROOT",
+	"_BPXK_AUTOCVT", "_CEE_RUNOPTS", "_TAG_REDIR_IN", "_TAG_REDIR_OUT", "_TAG_REDIR_ERR",
+}
+
+// envScript prints each of envVariables, or that it is not set.
+func envScript() string {
+	var b strings.Builder
+	for _, name := range envVariables {
+		fmt.Fprintf(&b, `if [ -n "${%[1]s+x}" ]; then printf '%%s\n' "%[1]s=$%[1]s"; else echo "%[1]s is not set"; fi; `, name)
+	}
+	return b.String()
+}
+
+func (t *ZopenTools) ZopenEnv(ctx context.Context, req *mcp.CallToolRequest, args TargetParams) (*mcp.CallToolResult, any, error) {
+	target, err := t.Config.Target(args.Target)
+	if err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	if err := t.Config.CheckEnv(args.Env); err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	res, err := target.Exec.Run(ctx, Command{Program: "/bin/sh", Args: []string{"-c", envScript()}, Env: args.Env})
+	if err != nil || res.ExitCode != 0 {
+		return commandToolResult(ctx, t.Outputs, res, err)
+	}
+
+	bootstrap := "none (commands run in the server's environment)"
+	if ssh, ok := target.Exec.(*SSHExecutor); ok {
+		bootstrap = ssh.bootstrap.Describe()
+	}
+	res.Stdout = fmt.Sprintf("Target: %s (%s)\nBootstrap: %s\n\n%s", target.Name, target.Address(), bootstrap, res.Stdout)
+	return commandToolResult(ctx, t.Outputs, res, nil)
+}
@@ -0,0 +1,189 @@
+// bootstrap_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// detectResponse answers the zopen-config detection as a host where found
+// is the zopen-config ~/.profile sources, or where there is none if found is
+// empty.
+func detectResponse(found string) func(cmd Command) (*CommandResult, error) {
+	return func(cmd Command) (*CommandResult, error) {
+		if found == "" {
+			return &CommandResult{Command: cmd.String(), Host: "zos1", ExitCode: 1}, nil
+		}
+		return &CommandResult{Command: cmd.String(), Host: "zos1", Stdout: found + "\n"}, nil
+	}
+}
+
+func TestRemoteBootstrapScript(t *testing.T) {
+	tests := []struct {
+		setting  string
+		found    string // zopen-config the detection finds
+		want     string
+		detects  bool // whether detection runs
+		describe string
+	}{
+		{"none", "", "", false, "none"},
+		{"profile", "", `. "$HOME"/.profile`, false, `. "$HOME"/.profile (setting profile)`},
+		{"profile:/etc/profile", "", ". /etc/profile", false, ". /etc/profile (setting profile:/etc/profile)"},
+		{"zopen-config:/usr/local/zopen/etc/zopen-config", "/u/ibmuser/zopen/etc/zopen-config", ". /usr/local/zopen/etc/zopen-config", false,
+			". /usr/local/zopen/etc/zopen-config (setting zopen-config:/usr/local/zopen/etc/zopen-config)"},
+		{"auto", "/u/ibmuser/zopen/etc/zopen-config", ". /u/ibmuser/zopen/etc/zopen-config", true,
+			". /u/ibmuser/zopen/etc/zopen-config (detected zopen-config, setting auto)"},
+		{"auto", "", `. "$HOME"/.profile`, true, `. "$HOME"/.profile (setting auto)`},
+		{"zopen-config", "/u/ibmuser/zopen/etc/zopen-config", ". /u/ibmuser/zopen/etc/zopen-config", true,
+			". /u/ibmuser/zopen/etc/zopen-config (detected zopen-config, setting zopen-config)"},
+	}
+	for _, tt := range tests {
+		fake := &FakeExecutor{Respond: detectResponse(tt.found)}
+		b := &remoteBootstrap{setting: tt.setting}
+		for i := 0; i < 2; i++ {
+			got, err := b.Script(context.Background(), fake.Run)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.setting, err)
+			}
+			if got != tt.want {
+				t.Errorf("%s: script = %q, want %q", tt.setting, got, tt.want)
+			}
+		}
+		// The result is cached, so detection runs at most once.
+		if n := len(fake.Calls()); (n == 1) != tt.detects || n > 1 {
+			t.Errorf("%s: ran %d detection command(s)", tt.setting, n)
+		}
+		if got := b.Describe(); got != tt.describe {
+			t.Errorf("%s: Describe() = %q, want %q", tt.setting, got, tt.describe)
+		}
+	}
+}
+
+func TestRemoteBootstrapRetriesFailedDetection(t *testing.T) {
+	found := ""
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) { return detectResponse(found)(cmd) }}
+	b := &remoteBootstrap{setting: "zopen-config"}
+
+	if _, err := b.Script(context.Background(), fake.Run); err == nil {
+		t.Fatal("expected an error when no zopen-config is found")
+	}
+	if got := b.Describe(); got != "zopen-config (not yet resolved)" {
+		t.Errorf("Describe() = %q after a failed detection", got)
+	}
+
+	// zopen is installed afterwards.
+	found = "/u/ibmuser/zopen/etc/zopen-config"
+	got, err := b.Script(context.Background(), fake.Run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != ". /u/ibmuser/zopen/etc/zopen-config" {
+		t.Errorf("script = %q", got)
+	}
+	if n := len(fake.Calls()); n != 2 {
+		t.Errorf("ran %d detection commands, want 2", n)
+	}
+}
+
+func TestRemoteBootstrapSharesDetection(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		close(started)
+		<-release
+		return detectResponse("/u/ibmuser/zopen/etc/zopen-config")(cmd)
+	}}
+	b := &remoteBootstrap{setting: "auto"}
+
+	const commands = 5
+	scripts := make(chan string, commands)
+	var wg sync.WaitGroup
+	run := func() {
+		defer wg.Done()
+		script, err := b.Script(context.Background(), fake.Run)
+		if err != nil {
+			t.Error(err)
+		}
+		scripts <- script
+	}
+	wg.Add(1)
+	go run()
+	<-started
+
+	// A command whose call ends while the detection is running stops
+	// waiting for it instead of being held up by the host.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.Script(ctx, fake.Run); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting command got %v, want a timeout", err)
+	}
+
+	for i := 1; i < commands; i++ {
+		wg.Add(1)
+		go run()
+	}
+	close(release)
+	wg.Wait()
+	close(scripts)
+	for script := range scripts {
+		if script != ". /u/ibmuser/zopen/etc/zopen-config" {
+			t.Errorf("script = %q", script)
+		}
+	}
+	if n := len(fake.Calls()); n != 1 {
+		t.Errorf("ran %d detection commands, want 1", n)
+	}
+}
+
+func TestRemoteBootstrapRetriesAbandonedDetection(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	calls := 0
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		calls++
+		if calls == 1 {
+			started <- struct{}{}
+			<-release
+			return nil, errors.New("session closed")
+		}
+		return detectResponse("/u/ibmuser/zopen/etc/zopen-config")(cmd)
+	}}
+	b := &remoteBootstrap{setting: "auto"}
+
+	// The command running the detection is cancelled part way through.
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := b.Script(ctx, fake.Run)
+		leader <- err
+	}()
+	<-started
+
+	waiter := make(chan string, 1)
+	go func() {
+		script, err := b.Script(context.Background(), fake.Run)
+		if err != nil {
+			t.Error(err)
+		}
+		waiter <- script
+	}()
+	// Give the waiter time to start waiting on the detection.
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	close(release)
+
+	if err := <-leader; err == nil {
+		t.Error("the cancelled command should fail")
+	}
+	// The waiter's own call is still live, so it detects again rather than
+	// failing with the other command's cancellation.
+	if script := <-waiter; script != ". /u/ibmuser/zopen/etc/zopen-config" {
+		t.Errorf("waiting command got script %q", script)
+	}
+	if n := len(fake.Calls()); n != 2 {
+		t.Errorf("ran %d detection commands, want 2", n)
+	}
+}
@@ -0,0 +1,276 @@
+// buildlog.go
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// --- Build Log Analysis ---
+
+const (
+	// maxBuildErrors caps the compiler and linker errors reported; the
+	// first ones are the ones worth fixing, the rest often follow from them.
+	maxBuildErrors = 10
+
+	// buildLogTailLines is how much of the failing phase's log a failed
+	// build shows inline.
+	buildLogTailLines = 100
+)
+
+// BuildAnalysis is what could be learned about a zopen build from its log.
+type BuildAnalysis struct {
+	Phases      []BuildPhase `json:"phases" jsonschema:"the phases of the build in the order they ran"`
+	FailedPhase string       `json:"failed_phase,omitempty" jsonschema:"the phase the build failed in, if it failed"`
+	Errors      []BuildError `json:"errors" jsonschema:"the first compiler and linker errors in the log"`
+	FailedHunks []PatchHunk  `json:"failed_hunks" jsonschema:"patch hunks that did not apply"`
+	Tests       *TestResults `json:"tests,omitempty" jsonschema:"results of the check phase, if the port reported them"`
+}
+
+// BuildPhase is a stretch of the build log belonging to one phase.
+type BuildPhase struct {
+	Name      string `json:"name" jsonschema:"download, patch, bootstrap, configure, build, check or install"`
+	StartLine int    `json:"start_line" jsonschema:"1-based line of the log the phase starts at"`
+	LineCount int    `json:"line_count" jsonschema:"number of log lines in the phase"`
+}
+
+// BuildError is a compiler or linker error found in the build log.
+type BuildError struct {
+	Kind    string `json:"kind" jsonschema:"compiler or linker"`
+	File    string `json:"file,omitempty" jsonschema:"source file the error is in, if known"`
+	Line    int    `json:"line,omitempty" jsonschema:"line in the source file, if known"`
+	Column  int    `json:"column,omitempty" jsonschema:"column in the source line, if known"`
+	Message string `json:"message" jsonschema:"the error message"`
+	Phase   string `json:"phase,omitempty" jsonschema:"the build phase the error occurred in"`
+	LogLine int    `json:"log_line" jsonschema:"1-based line of the log the error is on"`
+}
+
+// PatchHunk is a hunk of a port's patch that failed to apply.
+type PatchHunk struct {
+	Patch   string `json:"patch,omitempty" jsonschema:"the patch file being applied, if known"`
+	File    string `json:"file" jsonschema:"the file the hunk patches"`
+	Hunk    int    `json:"hunk,omitempty" jsonschema:"1-based number of the hunk within the file's changes, if known"`
+	Line    int    `json:"line,omitempty" jsonschema:"line of the file the hunk was expected at, if known"`
+	LogLine int    `json:"log_line" jsonschema:"1-based line of the log the failure is reported on"`
+}
+
+var (
+	// gnuError matches GCC and Clang diagnostics: file:line[:col]: error: msg.
+	gnuError = regexp.MustCompile(`^(\S[^:]*):(\d+):(?:(\d+):)?\s*(?:fatal )?error:\s*(.*)$`)
+
+	// xlcError matches IBM XL C/C++ diagnostics of severity error and up:
+	// "file.c", line 12.5: CCN3045 (S) msg.
+	xlcError = regexp.MustCompile(`^"([^"]+)", line (\d+)(?:\.(\d+))?: (\w+ \([SEU]\) .*)$`)
+
+	// driverError matches errors from a compiler driver with no location.
+	driverError = regexp.MustCompile(`^(?:\S*/)?(?:clang|clang\+\+|gcc|g\+\+|cc|c\+\+|c89|c99|xlc|xlC|xlclang|xlclang\+\+|ibm-clang|ibm-clang\+\+)(?:-\d+)?: (?:fatal )?error: (.*)$`)
+
+	// linkerError matches errors from the GNU and LLVM linkers and the z/OS
+	// binder.
+	linkerError = regexp.MustCompile(`(?i)undefined reference to|undefined symbol|unresolved (external )?symbol|linker command failed|^\S*ld(\.\w+)?: (fatal )?error|^collect2: error|^\s*IEW\d{4}[ESU]\b`)
+
+	// patchingFile matches GNU patch naming the file it is patching.
+	patchingFile = regexp.MustCompile(`^patching file '?([^']+?)'?$`)
+
+	// applyingPatch matches zopen and git announcing the patch they apply.
+	applyingPatch = regexp.MustCompile(`(?i)^\W*applying\s+(?:patch\s+)?'?(\S+?\.(?:patch|diff))'?`)
+
+	// hunkFailed matches GNU patch reporting a failed hunk.
+	hunkFailed = regexp.MustCompile(`^Hunk #(\d+) FAILED at (\d+)`)
+
+	// gitPatchFailed matches git apply reporting a failed hunk.
+	gitPatchFailed = regexp.MustCompile(`^error: patch failed: (.+):(\d+)$`)
+
+	// gitPatchRejected matches git apply rejecting the changes to a file.
+	gitPatchRejected = regexp.MustCompile(`^error: (.+): patch does not apply$`)
+)
+
+// analyzeBuildLog splits the log of a zopen build into phases and extracts
+// compiler and linker errors and failed patch hunks. If failed is set, the
+// phase the build failed in is the one of the last error found, or else
+// the last phase: a build that gets past a problem did not fail there.
+func analyzeBuildLog(log string, failed bool) *BuildAnalysis {
+	a := &BuildAnalysis{Phases: []BuildPhase{}, Errors: []BuildError{}, FailedHunks: []PatchHunk{}}
+	var phase, patch, patchTarget, errorPhase string
+	for i, line := range strings.Split(strings.TrimRight(stripANSI(log), "\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if p := detectPhase(line); p != "" && p != phase {
+			phase = p
+			a.Phases = append(a.Phases, BuildPhase{Name: phase, StartLine: i + 1})
+		}
+		if n := len(a.Phases); n > 0 {
+			a.Phases[n-1].LineCount++
+		}
+
+		if m := applyingPatch.FindStringSubmatch(line); m != nil {
+			patch = m[1]
+		}
+		if m := patchingFile.FindStringSubmatch(line); m != nil {
+			patchTarget = m[1]
+		}
+		if hunk, ok := parsePatchFailure(line, patchTarget, a.FailedHunks); ok {
+			hunk.Patch, hunk.LogLine = patch, i+1
+			a.FailedHunks = append(a.FailedHunks, hunk)
+			errorPhase = phase
+		}
+
+		if e, ok := parseBuildError(line); ok {
+			e.Phase, e.LogLine = phase, i+1
+			if len(a.Errors) < maxBuildErrors {
+				a.Errors = append(a.Errors, e)
+			}
+			errorPhase = phase
+		}
+	}
+
+	a.Tests = parseTestResults(log)
+	if failed {
+		a.FailedPhase = errorPhase
+		if a.FailedPhase == "" && len(a.Phases) > 0 {
+			a.FailedPhase = a.Phases[len(a.Phases)-1].Name
+		}
+	}
+	return a
+}
+
+// parseBuildError returns the compiler or linker error reported on line,
+// if any.
+func parseBuildError(line string) (BuildError, bool) {
+	trimmed := strings.TrimSpace(line)
+	if m := xlcError.FindStringSubmatch(trimmed); m != nil {
+		return BuildError{Kind: "compiler", File: m[1], Line: atoi(m[2]), Column: atoi(m[3]), Message: m[4]}, true
+	}
+	// A located error is checked before the linker patterns, which would
+	// also match its message, so that the file and line are kept.
+	if m := gnuError.FindStringSubmatch(trimmed); m != nil {
+		kind := "compiler"
+		if linkerError.MatchString(m[4]) {
+			kind = "linker"
+		}
+		return BuildError{Kind: kind, File: m[1], Line: atoi(m[2]), Column: atoi(m[3]), Message: m[4]}, true
+	}
+	if linkerError.MatchString(line) {
+		return BuildError{Kind: "linker", Message: trimmed}, true
+	}
+	if m := driverError.FindStringSubmatch(trimmed); m != nil {
+		return BuildError{Kind: "compiler", Message: m[1]}, true
+	}
+	return BuildError{}, false
+}
+
+// parsePatchFailure returns the failed hunk reported on line, if any. target
+// is the file GNU patch last said it was patching; failures already found
+// are used to skip git repeating a failure for the same file.
+func parsePatchFailure(line, target string, found []PatchHunk) (PatchHunk, bool) {
+	line = strings.TrimSpace(line)
+	if m := hunkFailed.FindStringSubmatch(line); m != nil {
+		return PatchHunk{File: target, Hunk: atoi(m[1]), Line: atoi(m[2])}, true
+	}
+	if m := gitPatchFailed.FindStringSubmatch(line); m != nil {
+		return PatchHunk{File: m[1], Line: atoi(m[2])}, true
+	}
+	if m := gitPatchRejected.FindStringSubmatch(line); m != nil {
+		for _, h := range found {
+			if h.File == m[1] {
+				return PatchHunk{}, false
+			}
+		}
+		return PatchHunk{File: m[1]}, true
+	}
+	return PatchHunk{}, false
+}
+
+// atoi converts a matched number, returning 0 for an empty match.
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// Summary describes a failed build for the text of a tool result.
+func (a *BuildAnalysis) Summary() string {
+	var b strings.Builder
+	if a.FailedPhase != "" {
+		fmt.Fprintf(&b, "zopen build failed in the %s phase.\n", a.FailedPhase)
+	} else {
+		b.WriteString("zopen build failed.\n")
+	}
+	if len(a.Errors) > 0 {
+		b.WriteString("\nFirst errors:\n")
+		for _, e := range a.Errors {
+			location := e.File
+			if e.Line > 0 {
+				location += fmt.Sprintf(":%d", e.Line)
+			}
+			if location != "" {
+				location += ": "
+			}
+			fmt.Fprintf(&b, "  [%s] %s%s (log line %d)\n", e.Kind, location, e.Message, e.LogLine)
+		}
+	}
+	if a.Tests != nil {
+		fmt.Fprintf(&b, "\nTest results: %s\n", a.Tests)
+	}
+	if len(a.FailedHunks) > 0 {
+		b.WriteString("\nFailed patch hunks:\n")
+		for _, h := range a.FailedHunks {
+			fmt.Fprintf(&b, "  %s", h.File)
+			if h.Hunk > 0 {
+				fmt.Fprintf(&b, " hunk #%d", h.Hunk)
+			}
+			if h.Line > 0 {
+				fmt.Fprintf(&b, " at line %d", h.Line)
+			}
+			if h.Patch != "" {
+				fmt.Fprintf(&b, " from %s", h.Patch)
+			}
+			fmt.Fprintf(&b, " (log line %d)\n", h.LogLine)
+		}
+	}
+	return b.String()
+}
+
+// Excerpt returns the end of the failed phase's part of log, and the
+// 1-based log lines it spans.
+func (a *BuildAnalysis) Excerpt(log string) (excerpt string, first, last int) {
+	lines := strings.Split(strings.TrimRight(stripANSI(log), "\n"), "\n")
+	first, last = 1, len(lines)
+	for i := len(a.Phases) - 1; i >= 0; i-- {
+		if p := a.Phases[i]; p.Name == a.FailedPhase {
+			first, last = p.StartLine, p.StartLine+p.LineCount-1
+			break
+		}
+	}
+	if last-first+1 > buildLogTailLines {
+		first = last - buildLogTailLines + 1
+	}
+	return strings.Join(lines[first-1:last], "\n") + "\n", first, last
+}
+
+// buildLog records the output of a build in the order it was produced, so
+// errors on stderr can be placed in the phase announced on stdout, and
+// passes each line on to progress, which may be nil.
+type buildLog struct {
+	progress *ProgressReporter
+
+	mu    sync.Mutex
+	lines []string
+}
+
+// Line records one line of output. It is safe for concurrent use by the
+// stdout and stderr streams of a command.
+func (l *buildLog) Line(line string, stderr bool) {
+	l.mu.Lock()
+	l.lines = append(l.lines, strings.TrimRight(line, "\r\n"))
+	l.mu.Unlock()
+	l.progress.Line(line, stderr)
+}
+
+// String returns the log recorded so far.
+func (l *buildLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "\n")
+}
@@ -0,0 +1,133 @@
+// buildlog_test.go
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeBuildLog(t *testing.T) {
+	tests := []struct {
+		file        string
+		phases      []string
+		failedPhase string
+		errors      []BuildError
+		hunks       []PatchHunk
+	}{
+		{
+			file:        "build-patch-failure.log",
+			phases:      []string{"download", "patch"},
+			failedPhase: "patch",
+			errors:      []BuildError{},
+			hunks: []PatchHunk{
+				{Patch: "/u/ibmuser/zopen/dev/zlibport/patches/zutil.h.patch", File: "zutil.h", Hunk: 2, Line: 212, LogLine: 9},
+				{Patch: "/u/ibmuser/zopen/dev/zlibport/patches/gzguts.h.patch", File: "gzguts.h", Line: 27, LogLine: 12},
+			},
+		},
+		{
+			file:        "build-compile-error.log",
+			phases:      []string{"configure", "build"},
+			failedPhase: "build",
+			errors: []BuildError{
+				{Kind: "compiler", File: "src/jv_print.c", Line: 88, Column: 5, Phase: "build", LogLine: 12,
+					Message: "call to undeclared function 'vasprintf'; ISO C99 and later do not support implicit function declarations [-Wimplicit-function-declaration]"},
+				{Kind: "compiler", File: "src/jv_print.c", Line: 112, Column: 3, Phase: "build", LogLine: 15,
+					Message: "use of undeclared identifier 'PATH_MAX'"},
+				{Kind: "compiler", File: "src/util.c", Line: 57, Column: 12, Phase: "build", LogLine: 18,
+					Message: "CCN3045 (S) Undeclared identifier O_CLOEXEC."},
+			},
+			hunks: []PatchHunk{},
+		},
+		{
+			file:        "build-binder-error.log",
+			phases:      []string{"build"},
+			failedPhase: "build",
+			errors: []BuildError{
+				{Kind: "linker", Phase: "build", LogLine: 5, Message: "IEW2456E 9207 SYMBOL ssl_ctx_new UNRESOLVED.  MEMBER COULD NOT BE INCLUDED"},
+				{Kind: "linker", Phase: "build", LogLine: 7, Message: "IEW2470E 9511 ORDERED SECTION CEESTART NOT FOUND IN MODULE."},
+				{Kind: "linker", Phase: "build", LogLine: 8, Message: "IEW2230S 0415 MODULE HAS BEEN MARKED NON-EXECUTABLE."},
+				{Kind: "linker", File: "lib/url.c", Line: 1201, Phase: "build", LogLine: 9, Message: "undefined symbol: Curl_ssl_init"},
+				{Kind: "linker", Phase: "build", LogLine: 10, Message: "clang: error: linker command failed with exit code 8 (use -v to see invocation)"},
+			},
+			hunks: []PatchHunk{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			a := analyzeBuildLog(readTestdata(t, tt.file), true)
+			var phases []string
+			for _, p := range a.Phases {
+				phases = append(phases, p.Name)
+			}
+			if !reflect.DeepEqual(phases, tt.phases) {
+				t.Errorf("phases = %q, want %q", phases, tt.phases)
+			}
+			if a.FailedPhase != tt.failedPhase {
+				t.Errorf("failed phase = %q, want %q", a.FailedPhase, tt.failedPhase)
+			}
+			if !reflect.DeepEqual(a.Errors, tt.errors) {
+				t.Errorf("errors:\n got %+v\nwant %+v", a.Errors, tt.errors)
+			}
+			if !reflect.DeepEqual(a.FailedHunks, tt.hunks) {
+				t.Errorf("failed hunks:\n got %+v\nwant %+v", a.FailedHunks, tt.hunks)
+			}
+		})
+	}
+}
+
+func TestZopenBuildTimeoutKeepsAnalysis(t *testing.T) {
+	// A zopen that hits a compile error and then hangs.
+	dir := t.TempDir()
+	zopen := filepath.Join(dir, "zopen")
+	script := "#!/bin/sh\necho 'Running make -j4'\necho \"foo.c:12:7: fatal error: 'zos.h' file not found\" >&2\nsleep 60\n"
+	if err := os.WriteFile(zopen, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	target := &Target{Name: "local", Exec: &LocalExecutor{}, ZopenPath: zopen}
+	tools := &ZopenTools{
+		Config:  &Config{Targets: map[string]*Target{"local": target}, DefaultTarget: "local"},
+		Outputs: NewOutputStore(defaultMaxOutputBytes),
+		Tests:   NewTestResultStore(""),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, out, _ := tools.ZopenBuild(ctx, nil, ZopenBuildParams{Directory: dir})
+	if out.Error == nil || out.Error.Code != CodeTimeout {
+		t.Fatalf("error = %+v, want %s", out.Error, CodeTimeout)
+	}
+	if out.Analysis == nil {
+		t.Fatal("no analysis of the output before the timeout")
+	}
+	if out.Analysis.FailedPhase != "build" || len(out.Analysis.Errors) != 1 || out.Analysis.Errors[0].File != "foo.c" {
+		t.Errorf("analysis = %+v, want the compile error in the build phase", out.Analysis)
+	}
+}
+
+func TestParseBuildError(t *testing.T) {
+	tests := []struct {
+		line string
+		want BuildError
+		ok   bool
+	}{
+		{"foo.c:12: error: undefined symbol", BuildError{Kind: "linker", File: "foo.c", Line: 12, Message: "undefined symbol"}, true},
+		{"foo.c:12:7: fatal error: 'zos.h' file not found", BuildError{Kind: "compiler", File: "foo.c", Line: 12, Column: 7, Message: "'zos.h' file not found"}, true},
+		{`"foo.c", line 3.1: CCN3275 (E) Unexpected text 'x' encountered.`, BuildError{Kind: "compiler", File: "foo.c", Line: 3, Column: 1, Message: "CCN3275 (E) Unexpected text 'x' encountered."}, true},
+		{"/usr/bin/ld: main.o: undefined reference to `zopen_init'", BuildError{Kind: "linker", Message: "/usr/bin/ld: main.o: undefined reference to `zopen_init'"}, true},
+		{"ld.lld: error: unable to find library -lz", BuildError{Kind: "linker", Message: "ld.lld: error: unable to find library -lz"}, true},
+		{"xlclang: error: no such file or directory: 'missing.c'", BuildError{Kind: "compiler", Message: "no such file or directory: 'missing.c'"}, true},
+		{"foo.c:12:7: warning: unused variable 'x'", BuildError{}, false},
+		{`"foo.c", line 60.1: CCN3280 (W) Function argument assignment.`, BuildError{}, false},
+		{"checking for error: in -lc... no", BuildError{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseBuildError(tt.line)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseBuildError(%q) = %+v, %v; want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// configfile.go
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Configuration File and Environment ---
+
+// envPrefix prefixes the environment variables that override flags, e.g.
+// ZOPEN_MCP_HOST for --host or ZOPEN_MCP_TOOL_TIMEOUT for --tool-timeout.
+const envPrefix = "ZOPEN_MCP_"
+
+// configFile is the layout of a --config file. Apart from targets and
+// profiles, every key is the name of a command-line flag, with dashes or
+// underscores, and takes the same values the flag does:
+//
+//	default_target: dev
+//	timeout: 15m
+//	tool_timeout:
+//	  zopen_build: 6h
+//	targets:
+//	  dev:
+//	    host: dev.example.com
+//	    user: ibmuser
+//	profiles:
+//	  prod:
+//	    default_target: prod
+//
+// YAML and JSON files are both accepted.
+type configFile struct {
+	Targets  map[string]targetConfig `yaml:"targets"`
+	Settings map[string]any          `yaml:",inline"`
+
+	// Profiles are named sections applied on top of the base settings when
+	// selected with --profile.
+	Profiles map[string]configSection `yaml:"profiles"`
+}
+
+// configSection holds the settings of one profile, or of the file itself.
+type configSection struct {
+	Targets  map[string]targetConfig `yaml:"targets"`
+	Settings map[string]any          `yaml:",inline"`
+}
+
+// targetConfig describes a target in a config file. Unset fields are filled
+// in from the corresponding flags, as for --target.
+type targetConfig struct {
+	Local              bool          `yaml:"local"`
+	Host               string        `yaml:"host"`
+	User               string        `yaml:"user"`
+	Key                string        `yaml:"key"`
+	Port               int           `yaml:"port"`
+	Codepage           string        `yaml:"codepage"`
+	Bootstrap          string        `yaml:"bootstrap"`
+	HostKeyFingerprint string        `yaml:"host_key_fingerprint"`
+	ProxyJump          string        `yaml:"proxy_jump"`
+	ProxyCommand       string        `yaml:"proxy_command"`
+	ConnectTimeout     time.Duration `yaml:"connect_timeout"`
+	KeepAlive          time.Duration `yaml:"keepalive"`
+	ZopenPath          string        `yaml:"zopen_path"`
+	ZopenGeneratePath  string        `yaml:"zopen_generate_path"`
+}
+
+// loadConfig applies settings from the environment and from the --config
+// file to the flags in fs, which must already have been parsed from args.
+// Command-line flags take precedence over environment variables, which take
+// precedence over the selected profile and then the rest of the file.
+func loadConfig(fs *flag.FlagSet, args []string, config *Config) error {
+	// So far fs has only been parsed from args, so the flags set are the
+	// ones given on the command line.
+	var onCommandLine []string
+	fs.Visit(func(f *flag.Flag) { onCommandLine = append(onCommandLine, f.Name) })
+
+	path := flagOrEnv(fs, "config")
+	profile := flagOrEnv(fs, "profile")
+
+	if path != "" {
+		file, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		base := configSection{Targets: file.Targets, Settings: file.Settings}
+		if err := base.apply(fs, config, path); err != nil {
+			return err
+		}
+		if profile != "" {
+			section, ok := file.Profiles[profile]
+			if !ok {
+				return fmt.Errorf("%s: no profile %q (available: %s)", path, profile, strings.Join(sortedKeys(file.Profiles), ", "))
+			}
+			if err := section.apply(fs, config, fmt.Sprintf("%s, profile %s", path, profile)); err != nil {
+				return err
+			}
+		}
+	} else if profile != "" {
+		return fmt.Errorf("--profile %s requires --config", profile)
+	}
+
+	if err := applyEnv(fs); err != nil {
+		return err
+	}
+	// Parse the command line again so that it wins over everything else.
+	for _, name := range onCommandLine {
+		resetFlag(fs, name)
+	}
+	return fs.Parse(args)
+}
+
+// resettableFlag is a flag whose values accumulate when it is given more
+// than once, such as --env-allow. A source of settings replaces the values
+// of the sources before it rather than adding to them, so the flag is reset
+// before each source that sets it.
+type resettableFlag interface {
+	flag.Value
+	Reset()
+}
+
+// resetFlag resets the named flag if it accumulates values.
+func resetFlag(fs *flag.FlagSet, name string) {
+	if f, ok := fs.Lookup(name).Value.(resettableFlag); ok {
+		f.Reset()
+	}
+}
+
+// flagOrEnv returns the value of the named flag, or of its environment
+// variable if the flag is empty.
+func flagOrEnv(fs *flag.FlagSet, name string) string {
+	if v := fs.Lookup(name).Value.String(); v != "" {
+		return v
+	}
+	return os.Getenv(envName(name))
+}
+
+// envName returns the environment variable that overrides flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// readConfigFile parses a YAML or JSON config file, rejecting unknown keys.
+func readConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var file configFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &file, nil
+}
+
+// apply sets the flags and targets of a section, reporting errors against
+// source.
+func (s *configSection) apply(fs *flag.FlagSet, config *Config, source string) error {
+	for _, key := range sortedKeys(s.Settings) {
+		name := strings.ReplaceAll(key, "_", "-")
+		if fs.Lookup(name) == nil || name == "config" || name == "profile" {
+			return fmt.Errorf("%s: unknown setting %q", source, key)
+		}
+		values, err := settingValues(s.Settings[key])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", source, key, err)
+		}
+		resetFlag(fs, name)
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %s: invalid value %q: %v", source, key, value, err)
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(s.Targets) {
+		tc := s.Targets[name]
+		target := &Target{
+			Name:               name,
+			Remote:             !tc.Local,
+			Host:               tc.Host,
+			User:               tc.User,
+			Key:                tc.Key,
+			Port:               tc.Port,
+			Codepage:           tc.Codepage,
+			Bootstrap:          tc.Bootstrap,
+			HostKeyFingerprint: tc.HostKeyFingerprint,
+			ProxyJump:          tc.ProxyJump,
+			ProxyCommand:       tc.ProxyCommand,
+			ConnectTimeout:     tc.ConnectTimeout,
+			KeepAlive:          tc.KeepAlive,
+			ZopenPath:          tc.ZopenPath,
+			ZopenGeneratePath:  tc.ZopenGeneratePath,
+		}
+		if tc.Local && (tc.Host != "" || tc.User != "" || tc.Key != "" || tc.Port != 0 || tc.Codepage != "" || tc.Bootstrap != "" || tc.HostKeyFingerprint != "" ||
+			tc.ProxyJump != "" || tc.ProxyCommand != "" || tc.ConnectTimeout != 0 || tc.KeepAlive != 0) {
+			return fmt.Errorf("%s: target %s: local targets only take zopen_path and zopen_generate_path", source, name)
+		}
+		if !tc.Local && tc.Host == "" {
+			return fmt.Errorf("%s: target %s: host is required (or set local: true)", source, name)
+		}
+		config.Targets[name] = target
+	}
+	return nil
+}
+
+// settingValues converts a config file value to the strings to pass to the
+// flag: a list sets a repeatable flag once per item, and a map sets it once
+// per key as key=value, as --tool-timeout expects.
+func settingValues(value any) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, fmt.Errorf("missing value")
+	case []any:
+		var values []string
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values, nil
+	case map[string]any:
+		var values []string
+		for _, key := range sortedKeys(v) {
+			values = append(values, fmt.Sprintf("%s=%v", key, v[key]))
+		}
+		return values, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// applyEnv sets every flag that has a ZOPEN_MCP_* environment variable.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		resetFlag(fs, f.Name)
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s=%q: %v", envName(f.Name), value, setErr)
+		}
+	})
+	return err
+}
+
+// sortedKeys returns the keys of m in order, so settings are applied
+// deterministically.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,109 @@
+// configfile_test.go
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// parseTestFlags parses args and the config file they name the way main
+// does, with a subset of the server's flags.
+func parseTestFlags(t *testing.T, args ...string) *Config {
+	t.Helper()
+	config := &Config{
+		Targets:      make(map[string]*Target),
+		ToolTimeouts: make(map[string]time.Duration),
+		EnvAllowlist: defaultEnvAllowlist,
+	}
+	fs := flag.NewFlagSet("zopen-mcp-server", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.String("config", "", "")
+	fs.String("profile", "", "")
+	fs.StringVar(&config.DefaultTarget, "default-target", "", "")
+	fs.DurationVar(&config.DefaultTimeout, "timeout", defaultTimeout, "")
+	fs.Var(&envAllowFlag{list: &config.EnvAllowlist}, "env-allow", "")
+	fs.Var(toolTimeoutFlag(config.ToolTimeouts), "tool-timeout", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, args, config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestLoadConfigEnvAllow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+env_allow: FOO
+profiles:
+  ci:
+    env_allow: [CI_*, BUILD_ID]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  string // ZOPEN_MCP_ENV_ALLOW
+		args []string
+		want []string
+	}{
+		{name: "default", want: defaultEnvAllowlist},
+		{name: "file", args: []string{"--config", path}, want: []string{"FOO"}},
+		{name: "profile replaces file", args: []string{"--config", path, "--profile", "ci"}, want: []string{"CI_*", "BUILD_ID"}},
+		{name: "environment replaces file", env: "BAZ", args: []string{"--config", path}, want: []string{"BAZ"}},
+		{name: "flag replaces file", args: []string{"--config", path, "--env-allow", "BAR"}, want: []string{"BAR"}},
+		{name: "flag replaces environment", env: "BAZ", args: []string{"--env-allow", "BAR"}, want: []string{"BAR"}},
+		{name: "repeated flags accumulate", args: []string{"--config", path, "--env-allow", "BAR", "--env-allow=QUX,BAR"}, want: []string{"BAR", "QUX"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv(envName("env-allow"), tt.env)
+			}
+			config := parseTestFlags(t, tt.args...)
+			if !slices.Equal(config.EnvAllowlist, tt.want) {
+				t.Errorf("allowlist = %q, want %q", config.EnvAllowlist, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+default_target: dev
+timeout: 15m
+tool_timeout:
+  zopen_build: 6h
+  zopen_install: 1h
+targets:
+  dev:
+    host: dev.example.com
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envName("timeout"), "20m")
+
+	config := parseTestFlags(t, "--config", path, "--default-target", "local", "--tool-timeout", "zopen_build=8h")
+	if config.DefaultTarget != "local" {
+		t.Errorf("default target = %q, want the command line's", config.DefaultTarget)
+	}
+	if config.DefaultTimeout != 20*time.Minute {
+		t.Errorf("timeout = %s, want the environment's", config.DefaultTimeout)
+	}
+	if config.ToolTimeouts["zopen_build"] != 8*time.Hour || config.ToolTimeouts["zopen_install"] != time.Hour {
+		t.Errorf("tool timeouts = %v", config.ToolTimeouts)
+	}
+	if target := config.Targets["dev"]; target == nil || target.Host != "dev.example.com" {
+		t.Errorf("target dev = %+v", target)
+	}
+}
@@ -0,0 +1,228 @@
+// encoding.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// --- Output Codepages ---
+
+// codepageAuto detects EBCDIC and other non-UTF-8 output line by line.
+const codepageAuto = "auto"
+
+// codepages are the encodings remote output can be converted from, keyed by
+// the names z/OS uses for them (as in chtag and iconv). "UTF-8" disables
+// conversion.
+var codepages = map[string]*charmap.Charmap{
+	"IBM-1047":  charmap.CodePage1047,
+	"IBM-037":   charmap.CodePage037,
+	"IBM-1140":  charmap.CodePage1140,
+	"ISO8859-1": charmap.ISO8859_1,
+	"UTF-8":     nil,
+}
+
+// ebcdicNewline is the EBCDIC NL character that ends lines in untagged
+// IBM-1047 text.
+const ebcdicNewline = 0x15
+
+// ebcdicThreshold is the share of a line's bytes that must decode to
+// printable text in IBM-1047 for the line to be treated as EBCDIC.
+const ebcdicThreshold = 0.9
+
+// codepageAliases maps other common spellings to the names in codepages.
+var codepageAliases = map[string]string{
+	"1047":       "IBM-1047",
+	"CP1047":     "IBM-1047",
+	"037":        "IBM-037",
+	"CP037":      "IBM-037",
+	"1140":       "IBM-1140",
+	"CP1140":     "IBM-1140",
+	"819":        "ISO8859-1",
+	"ISO-8859-1": "ISO8859-1",
+	"LATIN1":     "ISO8859-1",
+	"UTF8":       "UTF-8",
+	"NONE":       "UTF-8",
+}
+
+// normalizeCodepage validates a --codepage value and returns its canonical
+// name.
+func normalizeCodepage(name string) (string, error) {
+	if name == "" || strings.EqualFold(name, codepageAuto) {
+		return codepageAuto, nil
+	}
+	key := strings.ToUpper(name)
+	if alias, ok := codepageAliases[key]; ok {
+		key = alias
+	}
+	if _, ok := codepages[key]; !ok {
+		return "", fmt.Errorf("unsupported codepage %q (supported: auto, %s)", name, strings.Join(codepageNames(), ", "))
+	}
+	return key, nil
+}
+
+// codepageNames lists the supported codepages.
+func codepageNames() []string {
+	names := make([]string, 0, len(codepages))
+	for name := range codepages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ConversionReport records output that had to be converted to UTF-8.
+type ConversionReport struct {
+	Lines map[string]int // converted lines, keyed by source codepage
+}
+
+// String summarises the conversion for a tool result.
+func (r *ConversionReport) String() string {
+	var parts []string
+	for _, name := range codepageNames() {
+		if n := r.Lines[name]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d line(s) from %s", n, name))
+		}
+	}
+	return fmt.Sprintf("converted %s to UTF-8. The remote output was not UTF-8; "+
+		"check that _BPXK_AUTOCVT=ON is set in the SSH session and that files are tagged (chtag)",
+		strings.Join(parts, ", "))
+}
+
+// transcoder converts the output of a remote command to UTF-8 line by line,
+// so that EBCDIC lines mixed in with ASCII ones are handled and downstream
+// writers only ever see UTF-8 terminated by '\n'.
+type transcoder struct {
+	codepage string // codepageAuto or a key of codepages
+
+	mu    sync.Mutex
+	lines map[string]int
+}
+
+// newTranscoder returns a transcoder for the given canonical codepage, or nil
+// if conversion is disabled.
+func newTranscoder(codepage string) *transcoder {
+	if codepage == "UTF-8" {
+		return nil
+	}
+	return &transcoder{codepage: codepage, lines: make(map[string]int)}
+}
+
+// Writer wraps w so that everything written to it is converted first. The
+// returned writer's Flush must be called once the command has finished.
+func (t *transcoder) Writer(w io.Writer) *transcodeWriter {
+	return &transcodeWriter{t: t, w: w}
+}
+
+// Report returns what was converted, or nil if nothing was.
+func (t *transcoder) Report() *ConversionReport {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.lines) == 0 {
+		return nil
+	}
+	report := &ConversionReport{Lines: make(map[string]int, len(t.lines))}
+	for name, n := range t.lines {
+		report.Lines[name] = n
+	}
+	return report
+}
+
+// convert returns line as UTF-8.
+func (t *transcoder) convert(line []byte) []byte {
+	if isUTF8Text(line) {
+		return line
+	}
+	name := t.codepage
+	if name == codepageAuto {
+		switch {
+		case looksLikeEBCDIC(line):
+			name = "IBM-1047"
+		case utf8.Valid(line):
+			// Plain text with stray control characters.
+			return line
+		default:
+			name = "ISO8859-1"
+		}
+	}
+	decoded, err := codepages[name].NewDecoder().Bytes(line)
+	if err != nil {
+		return line
+	}
+	t.mu.Lock()
+	t.lines[name]++
+	t.mu.Unlock()
+	return decoded
+}
+
+// isUTF8Text reports whether line is valid UTF-8 free of control characters
+// other than tab, carriage return and escape (used for terminal colors).
+func isUTF8Text(line []byte) bool {
+	if !utf8.Valid(line) {
+		return false
+	}
+	for _, b := range line {
+		if b < 0x20 && b != '\t' && b != '\r' && b != 0x1b {
+			return false
+		}
+	}
+	return true
+}
+
+// looksLikeEBCDIC reports whether nearly all of line decodes to printable
+// text in IBM-1047.
+func looksLikeEBCDIC(line []byte) bool {
+	if len(line) == 0 {
+		return false
+	}
+	printable := 0
+	for _, b := range line {
+		r := charmap.CodePage1047.DecodeByte(b)
+		if r == ' ' || r == '\t' || r == '\r' || (r > 0x20 && r < 0x7f) {
+			printable++
+		}
+	}
+	return float64(printable)/float64(len(line)) >= ebcdicThreshold
+}
+
+// transcodeWriter buffers output up to each line break, ASCII or EBCDIC, and
+// writes the converted line to the underlying writer.
+type transcodeWriter struct {
+	t       *transcoder
+	w       io.Writer
+	pending []byte
+}
+
+func (w *transcodeWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexFunc(w.pending, func(r rune) bool { return r == '\n' || r == ebcdicNewline })
+		if i < 0 {
+			break
+		}
+		line := w.t.convert(w.pending[:i:i])
+		w.pending = w.pending[i+1:]
+		if _, err := w.w.Write(append(line, '\n')); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush converts and writes a final line that had no line break.
+func (w *transcodeWriter) Flush() {
+	if len(w.pending) > 0 {
+		w.w.Write(w.t.convert(w.pending))
+		w.pending = nil
+	}
+}
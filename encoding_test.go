@@ -0,0 +1,116 @@
+// encoding_test.go
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// ebcdic encodes s in IBM-1047, with its '\n' line breaks as EBCDIC NL.
+func ebcdic(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := charmap.CodePage1047.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf, _ := charmap.CodePage1047.EncodeRune('\n')
+	return bytes.ReplaceAll(b, []byte{lf}, []byte{ebcdicNewline})
+}
+
+// transcode writes each chunk to a writer for codepage and returns the
+// output and the conversion report.
+func transcode(codepage string, chunks ...[]byte) (string, *ConversionReport) {
+	tc := newTranscoder(codepage)
+	var out bytes.Buffer
+	w := tc.Writer(&out)
+	for _, c := range chunks {
+		w.Write(c)
+	}
+	w.Flush()
+	return out.String(), tc.Report()
+}
+
+func TestTranscoderIBM1047(t *testing.T) {
+	const text = "Hello, z/OS! [1.2.3] {ok}\nzopen install curl\n"
+	for _, codepage := range []string{"IBM-1047", codepageAuto} {
+		got, report := transcode(codepage, ebcdic(t, text))
+		if got != text {
+			t.Errorf("%s: got %q, want %q", codepage, got, text)
+		}
+		if report == nil || report.Lines["IBM-1047"] != 2 {
+			t.Errorf("%s: report = %+v, want 2 lines from IBM-1047", codepage, report)
+		}
+	}
+}
+
+func TestTranscoderPassesUTF8Through(t *testing.T) {
+	const text = "plain ASCII\n\x1b[32mcolored\x1b[0m\tand tabbed\r\nnaïve ✓ 漢字\nno line break"
+	got, report := transcode(codepageAuto, []byte(text))
+	if got != text {
+		t.Errorf("got %q, want %q", got, text)
+	}
+	if report != nil {
+		t.Errorf("report = %+v, want nil", report)
+	}
+	if newTranscoder("UTF-8") != nil {
+		t.Error("newTranscoder(UTF-8) should disable conversion")
+	}
+}
+
+func TestTranscoderMixedOutput(t *testing.T) {
+	// An EBCDIC line from an untagged file between lines zopen wrote in
+	// ASCII, and a Latin-1 one from a file tagged wrongly.
+	input := []byte("Installing curl\n")
+	input = append(input, ebcdic(t, "Successfully installed\n")...)
+	input = append(input, "caf\xe9\n"...)
+	input = append(input, "done\n"...)
+
+	got, report := transcode(codepageAuto, input)
+	if want := "Installing curl\nSuccessfully installed\ncafé\ndone\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if report == nil || report.Lines["IBM-1047"] != 1 || report.Lines["ISO8859-1"] != 1 {
+		t.Errorf("report = %+v, want 1 line each from IBM-1047 and ISO8859-1", report)
+	}
+}
+
+func TestTranscodeWriterSplitWrites(t *testing.T) {
+	// A multi-byte UTF-8 character split between two reads of the stream
+	// must not be taken for another encoding.
+	text := []byte("compiling 漢字.c\n")
+	i := bytes.Index(text, []byte("漢")) + 1
+	got, report := transcode(codepageAuto, text[:i], text[i:])
+	if got != string(text) {
+		t.Errorf("got %q, want %q", got, text)
+	}
+	if report != nil {
+		t.Errorf("report = %+v, want nil", report)
+	}
+
+	// Nor an EBCDIC line split before its NL.
+	line := ebcdic(t, "Hello from z/OS\n")
+	got, _ = transcode(codepageAuto, line[:5], line[5:])
+	if got != "Hello from z/OS\n" {
+		t.Errorf("got %q, want %q", got, "Hello from z/OS\n")
+	}
+}
+
+func TestLooksLikeEBCDIC(t *testing.T) {
+	tests := []struct {
+		name string
+		line []byte
+		want bool
+	}{
+		{"EBCDIC text", ebcdic(t, "zopen version 0.8.4"), true},
+		{"ASCII text", []byte("zopen version 0.8.4"), false},
+		{"binary", []byte{0x00, 0x01, 0x02, 0x03, 0xff, 0xfe}, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if got := looksLikeEBCDIC(tt.line); got != tt.want {
+			t.Errorf("%s: looksLikeEBCDIC(%q) = %v, want %v", tt.name, tt.line, got, tt.want)
+		}
+	}
+}
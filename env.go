@@ -0,0 +1,119 @@
+// env.go
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// --- Environment Variables ---
+
+// defaultEnvAllowlist lists the variables tool calls may set unless
+// --env-allow says otherwise.
+var defaultEnvAllowlist = []string{
+	"ZOPEN_ROOT", "ZOPEN_BUILD_LINE",
+	"CC", "CXX", "CFLAGS", "CXXFLAGS", "CPPFLAGS", "LDFLAGS", "LIBS",
+	"http_proxy", "https_proxy", "no_proxy", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY",
+}
+
+// envNamePattern matches valid environment variable names. Anything else
+// could not be exported by the remote shell.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envAllowFlag parses --env-allow. The first use after a reset replaces the
+// current allowlist, at first the default; values may be comma-separated and
+// may use * and ? wildcards.
+type envAllowFlag struct {
+	list *[]string
+	set  bool
+}
+
+func (f *envAllowFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+// Reset makes the next use replace the allowlist instead of adding to it.
+func (f *envAllowFlag) Reset() {
+	f.set = false
+}
+
+func (f *envAllowFlag) Set(value string) error {
+	if !f.set {
+		*f.list = nil
+		f.set = true
+	}
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+		if !slices.Contains(*f.list, pattern) {
+			*f.list = append(*f.list, pattern)
+		}
+	}
+	return nil
+}
+
+// CheckEnv verifies that a tool call may set every variable in env.
+func (c *Config) CheckEnv(env map[string]string) error {
+	for _, name := range sortedKeys(env) {
+		if !envNamePattern.MatchString(name) {
+			return validationError("invalid environment variable name %q", name)
+		}
+		if !c.envAllowed(name) {
+			allowed := "none"
+			if len(c.EnvAllowlist) > 0 {
+				allowed = strings.Join(c.EnvAllowlist, ", ")
+			}
+			return validationError("environment variable %s is not allowed (allowed: %s); the server's --env-allow controls which can be set", name, allowed)
+		}
+	}
+	return nil
+}
+
+// envAllowed reports whether name matches the allowlist.
+func (c *Config) envAllowed(name string) bool {
+	for _, pattern := range c.EnvAllowlist {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// envList renders env as sorted NAME=value entries.
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for _, name := range sortedKeys(env) {
+		list = append(list, name+"="+env[name])
+	}
+	return list
+}
+
+// formatEnv renders env for messages, with values quoted as for the shell.
+func formatEnv(env map[string]string) string {
+	list := make([]string, 0, len(env))
+	for _, name := range sortedKeys(env) {
+		list = append(list, name+"="+shellQuote(env[name]))
+	}
+	return strings.Join(list, " ")
+}
+
+// exportScript returns the shell snippet that exports env, or "" if it is
+// empty. Values are quoted, so they are never interpreted by the shell.
+func exportScript(env map[string]string) string {
+	var exports []string
+	for _, name := range sortedKeys(env) {
+		exports = append(exports, fmt.Sprintf("export %s=%s", name, shellQuote(env[name])))
+	}
+	return strings.Join(exports, " && ")
+}
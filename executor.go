@@ -0,0 +1,325 @@
+// executor.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// --- Executor Interface ---
+
+// Command describes a single program invocation on a target system.
+type Command struct {
+	Program string   // program to run, e.g. "zopen"
+	Args    []string // arguments passed to Program
+	Dir     string   // working directory; empty means the default
+
+	// Env holds environment variables to set for the command, on top of
+	// the target's environment.
+	Env map[string]string
+
+	// OnLine, if set, is called with each line of output as it is
+	// produced, in addition to the output being collected in the result.
+	OnLine func(line string, stderr bool)
+}
+
+// String renders the command for logs and messages.
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Program}, c.Args...), " ")
+}
+
+// CommandResult is the outcome of a command that ran to completion, whether
+// or not it succeeded.
+type CommandResult struct {
+	Command  string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+	Host     string
+
+	// Conversion is set when the output was not UTF-8 and was transcoded.
+	Conversion *ConversionReport
+
+	// Env holds the environment variables the call set for the command.
+	Env map[string]string
+
+	// packageCommand is set for zopen subcommands that name packages; see
+	// markPackageCommand.
+	packageCommand bool
+}
+
+// Output returns stdout followed by stderr, separated by a newline when both
+// are present.
+func (r *CommandResult) Output() string {
+	switch {
+	case r.Stderr == "":
+		return r.Stdout
+	case r.Stdout == "":
+		return r.Stderr
+	default:
+		return strings.TrimRight(r.Stdout, "\n") + "\n" + r.Stderr
+	}
+}
+
+// Executor runs commands on a target system. Run returns an error only if
+// the command could not be run at all (for example the program does not
+// exist or the host is unreachable); a command that ran and exited non-zero
+// is reported through CommandResult.ExitCode.
+type Executor interface {
+	Run(ctx context.Context, cmd Command) (*CommandResult, error)
+}
+
+// NotFoundError reports that the program to run does not exist on the target.
+type NotFoundError struct {
+	Program string
+	Host    string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("Command '%s' not found on %s. Is it in your PATH?", e.Program, e.Host)
+}
+
+// lineWriter splits a stream into lines and passes each one to fn.
+type lineWriter struct {
+	fn      func(line string, stderr bool)
+	stderr  bool
+	pending []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(string(w.pending[:i]), w.stderr)
+		w.pending = w.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush passes on a final line that had no trailing newline.
+func (w *lineWriter) Flush() {
+	if len(w.pending) > 0 {
+		w.fn(string(w.pending), w.stderr)
+		w.pending = nil
+	}
+}
+
+// outputWriters returns the writers a command's stdout and stderr should be
+// copied to, teeing into line callbacks when cmd.OnLine is set. The returned
+// flush function must be called once the command has finished.
+func outputWriters(cmd Command, stdout, stderr io.Writer) (io.Writer, io.Writer, func()) {
+	if cmd.OnLine == nil {
+		return stdout, stderr, func() {}
+	}
+	outLines := &lineWriter{fn: cmd.OnLine}
+	errLines := &lineWriter{fn: cmd.OnLine, stderr: true}
+	flush := func() {
+		outLines.Flush()
+		errLines.Flush()
+	}
+	return io.MultiWriter(stdout, outLines), io.MultiWriter(stderr, errLines), flush
+}
+
+// localHost is the Host reported for commands run on this machine.
+const localHost = "localhost"
+
+// --- Local Executor ---
+
+// LocalExecutor runs commands on the machine hosting the server.
+type LocalExecutor struct{}
+
+// Run executes cmd as a child process.
+func (e *LocalExecutor) Run(ctx context.Context, cmd Command) (*CommandResult, error) {
+	// Log command execution if DEBUG is set
+	if os.Getenv("DEBUG") != "" {
+		log.Printf("Executing: %s", cmd)
+	}
+
+	c := exec.CommandContext(ctx, cmd.Program, cmd.Args...)
+	c.Dir = cmd.Dir
+	if len(cmd.Env) > 0 {
+		c.Env = append(os.Environ(), envList(cmd.Env)...)
+	}
+	waited := setProcessGroup(c)
+
+	var stdout, stderr bytes.Buffer
+	var flush func()
+	c.Stdout, c.Stderr, flush = outputWriters(cmd, &stdout, &stderr)
+
+	start := time.Now()
+	err := c.Run()
+	waited()
+	flush()
+	if ctx.Err() != nil && c.ProcessState != nil && !c.ProcessState.Success() {
+		return nil, cancelledError(ctx, cmd, localHost, time.Since(start), nil)
+	}
+	result := &CommandResult{
+		Command:  cmd.String(),
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+		Host:     localHost,
+		Env:      cmd.Env,
+	}
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			if _, statErr := os.Stat(cmd.Dir); cmd.Dir != "" && statErr != nil {
+				return nil, validationError("directory does not exist: %s", cmd.Dir)
+			}
+			return nil, &NotFoundError{Program: cmd.Program, Host: localHost}
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to run %s: %w", cmd.Program, err)
+		}
+	}
+	result.ExitCode = c.ProcessState.ExitCode()
+	return result, nil
+}
+
+// --- SSH Executor ---
+
+// SSHExecutor runs commands on a remote target over pooled SSH connections.
+type SSHExecutor struct {
+	target    *Target
+	pool      *SSHPool
+	bootstrap *remoteBootstrap
+}
+
+// NewSSHExecutor creates an executor for the remote target.
+func NewSSHExecutor(target *Target, pool *SSHPool) *SSHExecutor {
+	return &SSHExecutor{target: target, pool: pool, bootstrap: &remoteBootstrap{setting: target.Bootstrap}}
+}
+
+// Run executes cmd in a new session on the remote system, after setting up
+// the environment with the target's bootstrap. If ctx is done before the
+// command finishes, the remote process group is terminated too; closing the
+// SSH session alone would leave it running on the host.
+func (e *SSHExecutor) Run(ctx context.Context, cmd Command) (*CommandResult, error) {
+	start := time.Now()
+	bootstrap, err := e.bootstrap.Script(ctx, func(ctx context.Context, cmd Command) (*CommandResult, error) {
+		return e.run(ctx, cmd, "")
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx, cmd, e.target.Host, time.Since(start), nil)
+		}
+		return nil, err
+	}
+	return e.run(ctx, cmd, bootstrap)
+}
+
+// run executes cmd with the given bootstrap snippet.
+func (e *SSHExecutor) run(ctx context.Context, cmd Command, bootstrap string) (*CommandResult, error) {
+	rc := &RemoteCommand{
+		Bootstrap: bootstrap,
+		Env:       cmd.Env,
+		Dir:       cmd.Dir,
+		Program:   cmd.Program,
+		Args:      cmd.Args,
+	}
+	if err := rc.Check(); err != nil {
+		return nil, err
+	}
+	remoteCmd := rc.String()
+
+	// Log command execution if DEBUG is set
+	if os.Getenv("DEBUG") != "" {
+		log.Printf("Executing on %s: %s", e.target.Host, remoteCmd)
+	}
+
+	start := time.Now()
+	session, err := e.pool.NewSession(ctx, e.target)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	stdoutWriter, stderrWriter, flush := outputWriters(cmd, &stdout, &stderr)
+	stderrCapture := &pidCapture{w: stderrWriter}
+	session.Stdout = stdoutWriter
+	session.Stderr = stderrCapture
+
+	// Convert EBCDIC or other non-UTF-8 output before anything else sees it.
+	transcoder := newTranscoder(e.target.Codepage)
+	var stdoutText, stderrText *transcodeWriter
+	if transcoder != nil {
+		stdoutText = transcoder.Writer(session.Stdout)
+		stderrText = transcoder.Writer(session.Stderr)
+		session.Stdout, session.Stderr = stdoutText, stderrText
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(withPIDReport(remoteCmd)) }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGTERM)
+		killErr := e.pool.killRemote(e.target, stderrCapture.pid.Load())
+		session.Close()
+		return nil, cancelledError(ctx, cmd, e.target.Host, time.Since(start), killErr)
+	}
+	if transcoder != nil {
+		stdoutText.Flush()
+		stderrText.Flush()
+	}
+	stderrCapture.Flush()
+	flush()
+
+	result := &CommandResult{
+		Command:    cmd.String(),
+		Stdout:     stdout.String(),
+		Stderr:     stderr.String(),
+		Duration:   time.Since(start),
+		Host:       e.target.Host,
+		Conversion: transcoder.Report(),
+		Env:        cmd.Env,
+	}
+	if err != nil {
+		var exitErr *ssh.ExitError
+		var missingErr *ssh.ExitMissingError
+		switch {
+		case errors.As(err, &exitErr):
+			result.ExitCode = exitErr.ExitStatus()
+		case errors.As(err, &missingErr):
+			// The session ended without the command reporting how it
+			// exited, which happens when the connection drops.
+			return nil, connectionError(fmt.Errorf("connection to %s was lost before %s finished", e.target.Host, cmd.Program))
+		default:
+			return nil, connectionError(fmt.Errorf("remote command failed: %w", err))
+		}
+	}
+	// The remote shell exits 127 when it cannot find the program, but so
+	// does a program that runs and fails to find a tool of its own; only the
+	// former has a message naming the program.
+	if result.ExitCode == 127 && programNotFound(cmd.Program, result.Stderr) {
+		return nil, &NotFoundError{Program: cmd.Program, Host: e.target.Host}
+	}
+	return result, nil
+}
+
+// programNotFound reports whether stderr holds the shell's message that it
+// could not find program, in the forms printed by dash ("sh: 1: zopen: not
+// found"), bash ("sh: line 1: zopen: command not found") and the z/OS shell
+// ("sh: zopen: FSUM7351 not found").
+func programNotFound(program, stderr string) bool {
+	pattern := regexp.MustCompile(`(?m)(?:^|[\s:])` + regexp.QuoteMeta(program) + `: (?:FSUM\d+ )?(?:command )?not found\s*$`)
+	return pattern.MatchString(stderr)
+}
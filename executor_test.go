@@ -0,0 +1,202 @@
+// executor_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// --- Fake Executor ---
+
+// FakeExecutor records the commands it is asked to run instead of running
+// them. Respond, if set, supplies the outcome of each command; otherwise
+// every command succeeds with no output.
+type FakeExecutor struct {
+	Respond func(cmd Command) (*CommandResult, error)
+
+	mu    sync.Mutex
+	calls []Command
+}
+
+// Run records cmd and returns the canned response.
+func (e *FakeExecutor) Run(ctx context.Context, cmd Command) (*CommandResult, error) {
+	e.mu.Lock()
+	e.calls = append(e.calls, cmd)
+	e.mu.Unlock()
+
+	if e.Respond == nil {
+		return &CommandResult{Command: cmd.String(), Host: "fake"}, nil
+	}
+	res, err := e.Respond(cmd)
+	if res != nil && cmd.OnLine != nil {
+		// Replay the canned output so progress handling can be exercised.
+		stdout, stderr, flush := outputWriters(cmd, io.Discard, io.Discard)
+		io.WriteString(stdout, res.Stdout)
+		io.WriteString(stderr, res.Stderr)
+		flush()
+	}
+	return res, err
+}
+
+// Calls returns the commands run so far, in order.
+func (e *FakeExecutor) Calls() []Command {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Command(nil), e.calls...)
+}
+
+// --- Tests ---
+
+func TestLocalExecutor(t *testing.T) {
+	e := &LocalExecutor{}
+	ctx := context.Background()
+
+	res, err := e.Run(ctx, Command{Program: "/bin/sh", Args: []string{"-c", `echo "$GREETING"; echo err >&2; exit 4`}, Env: map[string]string{"GREETING": "hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stdout != "hello\n" || res.Stderr != "err\n" || res.ExitCode != 4 {
+		t.Errorf("got stdout %q, stderr %q, exit code %d", res.Stdout, res.Stderr, res.ExitCode)
+	}
+
+	_, err = e.Run(ctx, Command{Program: "zopen-mcp-no-such-program"})
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("missing program: got %v, want a NotFoundError", err)
+	}
+
+	_, err = e.Run(ctx, Command{Program: "true", Dir: "/no/such/dir"})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Errorf("missing directory: got %v, want a ValidationError", err)
+	}
+}
+
+func TestProgramNotFound(t *testing.T) {
+	tests := []struct {
+		program string
+		stderr  string
+		want    bool
+	}{
+		{"zopen", "sh: 1: zopen: not found\n", true},
+		{"zopen", "/bin/sh: line 1: zopen: command not found\n", true},
+		{"zopen", "/bin/sh: zopen: FSUM7351 not found\n", true},
+		{"/usr/lpp/zopen/bin/zopen", "sh: 1: /usr/lpp/zopen/bin/zopen: not found\n", true},
+		{"zopen", "sh: 1: exec: zopen: not found\n", true},
+		// Something the program itself could not find.
+		{"zopen", "/u/ibmuser/zopen/bin/zopen: line 12: curl: not found\n", false},
+		{"/bin/sh", "/bin/sh: 1: make: not found\n", false},
+		{"/bin/sh", "/bin/sh: make: FSUM7351 not found\n", false},
+		{"zopen", "zopen: package bashx not found in the repository\n", false},
+		{"zopen", "", false},
+	}
+	for _, tt := range tests {
+		if got := programNotFound(tt.program, tt.stderr); got != tt.want {
+			t.Errorf("programNotFound(%q, %q) = %v, want %v", tt.program, tt.stderr, got, tt.want)
+		}
+	}
+}
+
+func TestSSHExecutorExit127(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+	executor := NewSSHExecutor(srv.target(keyFile), pool)
+	ctx := context.Background()
+
+	_, err := executor.Run(ctx, Command{Program: "zopen-mcp-no-such-program", Args: []string{"list"}})
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("missing program: got %v, want a NotFoundError", err)
+	}
+
+	// A command that runs and then cannot find a tool keeps its output.
+	res, err := executor.Run(ctx, Command{Program: "/bin/sh", Args: []string{"-c", "echo building; zopen-mcp-no-such-tool"}})
+	if err != nil {
+		t.Fatalf("failing step: got %v, want a result", err)
+	}
+	if res.ExitCode != 127 || res.Stdout != "building\n" || res.Stderr == "" {
+		t.Errorf("failing step: got exit code %d, stdout %q, stderr %q", res.ExitCode, res.Stdout, res.Stderr)
+	}
+	if code := classifyError(res, nil); code != CodeExit {
+		t.Errorf("failing step classified as %q, want %q", code, CodeExit)
+	}
+}
+
+func TestFakeExecutorReplaysOutput(t *testing.T) {
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		return &CommandResult{Command: cmd.String(), Stdout: "one\ntwo", Stderr: "warn\n"}, nil
+	}}
+	var lines []string
+	cmd := Command{Program: "zopen", Args: []string{"install", "bash"}, OnLine: func(line string, stderr bool) {
+		lines = append(lines, fmt.Sprintf("%v:%s", stderr, line))
+	}}
+	if _, err := fake.Run(context.Background(), cmd); err != nil {
+		t.Fatal(err)
+	}
+	// A final line without a newline is passed on when the command ends.
+	want := []string{"false:one", "true:warn", "false:two"}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+	if calls := fake.Calls(); len(calls) != 1 || calls[0].String() != "zopen install bash" {
+		t.Errorf("calls = %v", calls)
+	}
+}
+
+func TestRunReadOnlyRetriesConnectionErrors(t *testing.T) {
+	failures := 1
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		if failures > 0 {
+			failures--
+			return nil, connectionError(errors.New("connection reset"))
+		}
+		return &CommandResult{Command: cmd.String(), Stdout: "ok\n"}, nil
+	}}
+	target := &Target{Name: "dev", Exec: fake}
+	res, err := runReadOnly(context.Background(), target, Command{Program: "zopen", Args: []string{"list"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stdout != "ok\n" || len(fake.Calls()) != 2 {
+		t.Errorf("got stdout %q after %d calls, want %q after 2", res.Stdout, len(fake.Calls()), "ok\n")
+	}
+
+	// Other failures are not retried.
+	fake = &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		return nil, authError(errors.New("rejected"))
+	}}
+	target.Exec = fake
+	if _, err := runReadOnly(context.Background(), target, Command{Program: "zopen"}); classifyError(nil, err) != CodeAuth || len(fake.Calls()) != 1 {
+		t.Errorf("auth failure: got %v after %d calls, want it after 1", err, len(fake.Calls()))
+	}
+}
+
+func TestRunReadOnlyCancelledDuringBackoff(t *testing.T) {
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		return nil, connectionError(errors.New("connection reset"))
+	}}
+	target := &Target{Name: "dev", Exec: fake}
+	ctx, cancel := context.WithTimeout(context.Background(), retryBackoff/10)
+	defer cancel()
+
+	// The call ends while waiting to retry: that is a timeout, not the
+	// connection failure that led to the wait.
+	_, err := runReadOnly(ctx, target, Command{Program: "zopen", Args: []string{"list"}})
+	var cancelled *CancelledError
+	if !errors.As(err, &cancelled) || !cancelled.TimedOut || cancelled.Host != "dev" {
+		t.Fatalf("got %v, want a timeout on dev", err)
+	}
+	if code := classifyError(nil, err); code != CodeTimeout {
+		t.Errorf("error code = %q, want %q", code, CodeTimeout)
+	}
+	if n := len(fake.Calls()); n != 1 {
+		t.Errorf("ran %d times, want 1", n)
+	}
+}
@@ -0,0 +1,202 @@
+// failures.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+// --- Error Codes ---
+
+// ErrorCode says why a tool call failed. Codes are stable, so clients can
+// branch on them instead of parsing messages, and a dropped SSH connection is
+// not mistaken for zopen itself failing.
+type ErrorCode string
+
+const (
+	CodeBinaryNotFound  ErrorCode = "binary_not_found"   // zopen or zopen-generate is not installed on the target
+	CodeConnection      ErrorCode = "ssh_connect_failed" // host unreachable or connection lost
+	CodeAuth            ErrorCode = "auth_failed"        // no usable credentials, or the server rejected them
+	CodeHostKey         ErrorCode = "host_key_rejected"  // the host key could not be verified
+	CodeExit            ErrorCode = "nonzero_exit"       // the command ran and exited non-zero
+	CodeTimeout         ErrorCode = "timeout"            // the call hit its deadline
+	CodeCancelled       ErrorCode = "cancelled"          // the client cancelled the call
+	CodeValidation      ErrorCode = "validation_error"   // the arguments were rejected before anything ran
+	CodePackageNotFound ErrorCode = "package_not_found"  // zopen does not know a package the call named
+	CodeLockHeld        ErrorCode = "lock_held"          // another zopen process held zopen's lock throughout
+	CodeInternal        ErrorCode = "internal_error"     // anything else
+)
+
+// TransportError reports that a command could not be run, or did not finish,
+// because of the SSH connection rather than the command itself.
+type TransportError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *TransportError) Error() string { return e.Err.Error() }
+func (e *TransportError) Unwrap() error { return e.Err }
+
+// connectionError marks err as a connection failure.
+func connectionError(err error) error {
+	return &TransportError{Code: CodeConnection, Err: err}
+}
+
+// authError marks err as an authentication failure.
+func authError(err error) error {
+	return &TransportError{Code: CodeAuth, Err: err}
+}
+
+// ValidationError reports that a tool call's arguments were rejected, so
+// nothing was run.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// validationError returns a ValidationError with a formatted message.
+func validationError(format string, args ...any) error {
+	return &ValidationError{Err: fmt.Errorf(format, args...)}
+}
+
+// packageNotFoundPattern matches the line zopen prints when a package it was
+// asked about does not exist, after any error prefix.
+var packageNotFoundPattern = regexp.MustCompile(`(?m)^\W*(ERROR:\s*)?Package [\w.+-]+ not found\b`)
+
+// packageCommands are the zopen subcommands that name packages, so whose
+// failures may be zopen not knowing one. Other commands, such as builds,
+// print similar messages of their own, like pkg-config's.
+var packageCommands = map[string]bool{
+	"query":   true,
+	"info":    true,
+	"install": true,
+	"remove":  true,
+	"upgrade": true,
+}
+
+// markPackageCommand records on res whether it is the result of the zopen
+// subcommand in zopenArgs naming packages.
+func markPackageCommand(res *CommandResult, zopenArgs []string) {
+	if res != nil && len(zopenArgs) > 0 && packageCommands[zopenArgs[0]] {
+		res.packageCommand = true
+	}
+}
+
+// classifyError returns the code for the outcome of a command, or "" if it
+// succeeded.
+func classifyError(res *CommandResult, err error) ErrorCode {
+	var transportErr *TransportError
+	var hostKeyErr *HostKeyError
+	var notFoundErr *NotFoundError
+	var validationErr *ValidationError
+	var cancelledErr *CancelledError
+	var queuedErr *QueuedError
+	switch {
+	case err == nil:
+		switch {
+		case res == nil || res.ExitCode == 0:
+			return ""
+		case lockHeld(res):
+			return CodeLockHeld
+		case res.packageCommand && packageNotFoundPattern.MatchString(stripANSI(res.Output())):
+			return CodePackageNotFound
+		default:
+			return CodeExit
+		}
+	case errors.As(err, &hostKeyErr):
+		return CodeHostKey
+	case errors.As(err, &transportErr):
+		return transportErr.Code
+	case errors.As(err, &notFoundErr):
+		return CodeBinaryNotFound
+	case errors.As(err, &validationErr):
+		return CodeValidation
+	case errors.As(err, &cancelledErr):
+		if cancelledErr.TimedOut {
+			return CodeTimeout
+		}
+		return CodeCancelled
+	case errors.As(err, &queuedErr):
+		if queuedErr.TimedOut {
+			return CodeTimeout
+		}
+		return CodeCancelled
+	default:
+		return CodeInternal
+	}
+}
+
+// ToolError is the structured form of a failed tool call, returned as
+// structured content alongside the text result.
+type ToolError struct {
+	Code     ErrorCode `json:"code" jsonschema:"stable error code: binary_not_found, ssh_connect_failed, auth_failed, host_key_rejected, nonzero_exit, timeout, cancelled, validation_error, package_not_found, lock_held or internal_error"`
+	Message  string    `json:"message" jsonschema:"human-readable description of the error"`
+	ExitCode int       `json:"exit_code,omitempty" jsonschema:"exit code of the command, if it ran and failed"`
+}
+
+// newToolError returns the ToolError for the outcome of a command, or nil if
+// it succeeded.
+func newToolError(res *CommandResult, err error) *ToolError {
+	code := classifyError(res, err)
+	switch {
+	case code == "":
+		return nil
+	case err != nil:
+		return &ToolError{Code: code, Message: err.Error()}
+	default:
+		return &ToolError{
+			Code:     code,
+			Message:  fmt.Sprintf("'%s' on %s exited with code %d", res.Command, res.Host, res.ExitCode),
+			ExitCode: res.ExitCode,
+		}
+	}
+}
+
+// ErrorOutput is the structured content of tools that return only text when
+// they succeed.
+type ErrorOutput struct {
+	Error *ToolError `json:"error,omitempty" jsonschema:"why the call failed"`
+}
+
+// --- Retrying Read-Only Commands ---
+
+const (
+	// readOnlyRetries is how many times a read-only command is retried
+	// after a connection failure.
+	readOnlyRetries = 3
+
+	// retryBackoff is the pause before the first retry; it doubles with
+	// each further attempt.
+	retryBackoff = time.Second
+)
+
+// runReadOnly runs cmd on target, retrying with backoff if the connection
+// fails. Only commands that change nothing on the target may be retried: a
+// connection lost while a command runs leaves it unknown whether the command
+// took effect.
+func runReadOnly(ctx context.Context, target *Target, cmd Command) (*CommandResult, error) {
+	start := time.Now()
+	delay := retryBackoff
+	for attempt := 0; ; attempt++ {
+		res, err := target.Exec.Run(ctx, cmd)
+		if classifyError(res, err) != CodeConnection {
+			return res, err
+		}
+		if attempt == readOnlyRetries {
+			return nil, fmt.Errorf("%w (gave up after %d retries)", err, attempt)
+		}
+		log.Printf("Warning: target %s: %s failed to connect, retrying in %s: %v", target.Name, cmd, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, cancelledError(ctx, cmd, target.Name, time.Since(start), nil)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
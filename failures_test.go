@@ -0,0 +1,67 @@
+// failures_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	// exited returns the result of a command that failed with output.
+	exited := func(args []string, stderr string) *CommandResult {
+		res := &CommandResult{Command: "zopen", ExitCode: 1, Stderr: stderr}
+		markPackageCommand(res, args)
+		return res
+	}
+	install := []string{"install", "--yes", "nosuchpkg"}
+	build := []string{"build"}
+
+	tests := []struct {
+		name string
+		res  *CommandResult
+		err  error
+		want ErrorCode
+	}{
+		{"success", &CommandResult{}, nil, ""},
+		{"no result", nil, nil, ""},
+		{"exit", exited(build, "make: *** [all] Error 2\n"), nil, CodeExit},
+		{"lock held", exited(install, "Could not obtain the lock: another zopen process is running\n"), nil, CodeLockHeld},
+		{"package not found", exited(install, "Package nosuchpkg not found\n"), nil, CodePackageNotFound},
+		{"package not found with error prefix", exited([]string{"info", "nosuchpkg"}, "\x1b[31m***ERROR: Package nosuchpkg not found in the zopen community\x1b[0m\n"), nil, CodePackageNotFound},
+		{"not found in a build", exited(build, "Package nosuchpkg not found\n"), nil, CodeExit},
+		{"pkg-config in a build", exited(build, "configure: error: No package 'libffi' found\n"), nil, CodeExit},
+		{"pkg-config in an install", exited(install, "No package 'libffi' found\n"), nil, CodeExit},
+		{"not found mid-line", exited(install, "curl: dependency package foo not found\n"), nil, CodeExit},
+		{"host key", nil, &HostKeyError{Reason: "changed"}, CodeHostKey},
+		{"connection", nil, connectionError(errors.New("connection refused")), CodeConnection},
+		{"auth", nil, authError(errors.New("rejected")), CodeAuth},
+		{"binary not found", nil, &NotFoundError{Program: "zopen"}, CodeBinaryNotFound},
+		{"validation", nil, validationError("bad argument"), CodeValidation},
+		{"timeout", nil, &CancelledError{TimedOut: true}, CodeTimeout},
+		{"cancelled", nil, &CancelledError{}, CodeCancelled},
+		{"queue timeout", nil, &QueuedError{TimedOut: true}, CodeTimeout},
+		{"queue cancelled", nil, &QueuedError{}, CodeCancelled},
+		{"internal", nil, errors.New("boom"), CodeInternal},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.res, tt.err); got != tt.want {
+			t.Errorf("%s: classifyError = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestZopenInfoPackageNotFound(t *testing.T) {
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		return &CommandResult{Command: cmd.String(), Host: "fake", ExitCode: 1,
+			Stderr: "Package nosuchpkg not found\n"}, nil
+	}}
+	tools := &ZopenTools{
+		Config:  &Config{Targets: map[string]*Target{"local": {Name: "local", Exec: fake}}, DefaultTarget: "local"},
+		Outputs: NewOutputStore(defaultMaxOutputBytes),
+	}
+	_, out, _ := tools.ZopenInfo(context.Background(), nil, ZopenInfoParams{Package: "nosuchpkg"})
+	if out.Error == nil || out.Error.Code != CodePackageNotFound {
+		t.Errorf("error = %+v, want %s", out.Error, CodePackageNotFound)
+	}
+}
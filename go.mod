@@ -4,9 +4,16 @@ go 1.23.0
 
 toolchain go1.23.10
 
-require github.com/modelcontextprotocol/go-sdk v0.3.0
+require (
+	github.com/kevinburke/ssh_config v1.2.0
+	github.com/modelcontextprotocol/go-sdk v0.3.0
+	golang.org/x/crypto v0.39.0
+	golang.org/x/text v0.26.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/google/jsonschema-go v0.2.0 // indirect
 	github.com/yosida95/uritemplate/v3 v3.0.2 // indirect
+	golang.org/x/sys v0.33.0 // indirect
 )
@@ -0,0 +1,207 @@
+// hostkey.go
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// --- Host Key Verification ---
+
+// HostKeyError reports that a remote host presented a key we could not verify.
+type HostKeyError struct {
+	Host        string   // host:port that was dialed
+	Fingerprint string   // SHA256 fingerprint of the key the host presented
+	Expected    []string // fingerprints we expected, if the host was known
+	Reason      string   // "mismatch", "changed" or "unknown"
+}
+
+func (e *HostKeyError) Error() string {
+	switch e.Reason {
+	case "mismatch":
+		return fmt.Sprintf("host key verification failed for %s: presented key %s does not match --host-key-fingerprint %s",
+			e.Host, e.Fingerprint, strings.Join(e.Expected, ", "))
+	case "changed":
+		return fmt.Sprintf("host key verification failed for %s: HOST KEY HAS CHANGED (presented %s, expected %s). "+
+			"If the change is legitimate, remove the old entry from your known_hosts file",
+			e.Host, e.Fingerprint, strings.Join(e.Expected, ", "))
+	default:
+		return fmt.Sprintf("host key verification failed for %s: unknown host key %s and trust-on-first-use is disabled",
+			e.Host, e.Fingerprint)
+	}
+}
+
+// trustStoreMu serializes appends to the trust-on-first-use store.
+var trustStoreMu sync.Mutex
+
+// defaultKnownHostsFile returns the user's ~/.ssh/known_hosts path.
+func defaultKnownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// defaultTrustStore returns the file where the server pins host keys it
+// accepted on first use.
+func defaultTrustStore() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "zopen-mcp-server", "known_hosts")
+}
+
+// hostKeyCallback builds the host key policy for target:
+//   - with --host-key-fingerprint, the presented key must match it exactly;
+//   - otherwise the key is checked against known_hosts and the trust store;
+//   - an unknown host is pinned to the trust store when trust-on-first-use is
+//     enabled and rejected otherwise. A known host with a different key is
+//     always rejected.
+//
+// The returned algorithms function is called with the remote address of the
+// connection once it is made. When the host is already on record, under addr
+// or that address, it restricts the handshake to the key types we hold for
+// it, so a host that also offers a different key type is not mistaken for one
+// whose key has changed.
+func hostKeyCallback(config *Config, target *Target, addr string) (ssh.HostKeyCallback, func(remote net.Addr) []string, error) {
+	if target.HostKeyFingerprint != "" {
+		want := target.HostKeyFingerprint
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			got := ssh.FingerprintSHA256(key)
+			if got != want {
+				return &HostKeyError{Host: hostname, Fingerprint: got, Expected: []string{want}, Reason: "mismatch"}
+			}
+			return nil
+		}, func(net.Addr) []string { return nil }, nil
+	}
+
+	var files []string
+	for _, path := range []string{config.KnownHostsFile, config.TrustStore} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+
+	var known ssh.HostKeyCallback
+	if len(files) > 0 {
+		var err error
+		known, err = knownhosts.New(files...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load known hosts: %w", err)
+		}
+	}
+	algorithms := func(remote net.Addr) []string {
+		return knownHostKeyAlgorithms(known, addr, remote)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if known != nil {
+			err := known(hostname, remote, key)
+			if err == nil {
+				return nil
+			}
+			var keyErr *knownhosts.KeyError
+			if !errors.As(err, &keyErr) {
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				var expected []string
+				for _, k := range keyErr.Want {
+					expected = append(expected, ssh.FingerprintSHA256(k.Key))
+				}
+				return &HostKeyError{
+					Host:        hostname,
+					Fingerprint: ssh.FingerprintSHA256(key),
+					Expected:    expected,
+					Reason:      "changed",
+				}
+			}
+		}
+
+		if !config.AcceptNewHostKeys || config.TrustStore == "" {
+			return &HostKeyError{Host: hostname, Fingerprint: ssh.FingerprintSHA256(key), Reason: "unknown"}
+		}
+		return pinHostKey(config.TrustStore, hostname, key)
+	}, algorithms, nil
+}
+
+// knownHostKeyAlgorithms returns the host key algorithms matching the keys on
+// record for addr or the remote address, or nil if the host is unknown. It
+// must see the same remote address as the handshake, since known_hosts
+// entries are often keyed by IP address.
+func knownHostKeyAlgorithms(known ssh.HostKeyCallback, addr string, remote net.Addr) []string {
+	if known == nil {
+		return nil
+	}
+
+	// Probing with a throwaway key makes knownhosts report every key it holds
+	// for the host in KeyError.Want.
+	_, probe, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	signer, err := ssh.NewSignerFromKey(probe)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(known(addr, remote, signer.PublicKey()), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, k := range keyErr.Want {
+		algos := []string{k.Key.Type()}
+		if k.Key.Type() == ssh.KeyAlgoRSA {
+			algos = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, a := range algos {
+			if !seen[a] {
+				seen[a] = true
+				algorithms = append(algorithms, a)
+			}
+		}
+	}
+	return algorithms
+}
+
+// pinHostKey records key for hostname in the trust store.
+func pinHostKey(store, hostname string, key ssh.PublicKey) error {
+	trustStoreMu.Lock()
+	defer trustStoreMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(store), 0o700); err != nil {
+		return fmt.Errorf("failed to create trust store directory: %w", err)
+	}
+	f, err := os.OpenFile(store, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open trust store: %w", err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return fmt.Errorf("failed to write trust store: %w", err)
+	}
+	if os.Getenv("DEBUG") != "" {
+		log.Printf("Pinned host key %s for %s in %s", ssh.FingerprintSHA256(key), hostname, store)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+// output.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// --- Output Limits ---
+
+const (
+	// defaultMaxOutputBytes is the default cap on output returned inline.
+	defaultMaxOutputBytes = 64 * 1024
+
+	// outputStoreCapacity bounds the total size of stored outputs; the
+	// oldest are evicted first.
+	outputStoreCapacity = 64 * 1024 * 1024
+
+	// defaultReadBytes is the page size of zopen_output_read in byte mode.
+	defaultReadBytes = 32 * 1024
+
+	// defaultReadLines is the page size of zopen_output_read in line mode.
+	defaultReadLines = 500
+)
+
+// OutputStore caps the command output returned inline in tool results and
+// keeps the complete output of truncated commands so that it can be paged
+// through with zopen_output_read. Outputs belong to the client session that
+// ran the command, so clients of a shared HTTP server cannot read each
+// other's.
+type OutputStore struct {
+	limit int
+
+	mu      sync.Mutex
+	entries map[string]*storedOutput
+	order   []string // IDs, oldest first
+	size    int
+}
+
+// storedOutput is the full output of one command.
+type storedOutput struct {
+	ID      string
+	Session *mcp.ServerSession
+	Command string
+	Host    string
+	Created time.Time
+	Text    string
+}
+
+// NewOutputStore creates a store that inlines at most limit bytes of output.
+// A limit of zero or less disables truncation.
+func NewOutputStore(limit int) *OutputStore {
+	return &OutputStore{limit: limit, entries: make(map[string]*storedOutput)}
+}
+
+// outputSessionKey is the context key of the session a tool call came from.
+type outputSessionKey struct{}
+
+// withOutputSession returns ctx recording the session outputs stored during
+// the call belong to.
+func withOutputSession(ctx context.Context, session *mcp.ServerSession) context.Context {
+	return context.WithValue(ctx, outputSessionKey{}, session)
+}
+
+// outputSession returns the session recorded in ctx, or nil.
+func outputSession(ctx context.Context) *mcp.ServerSession {
+	session, _ := ctx.Value(outputSessionKey{}).(*mcp.ServerSession)
+	return session
+}
+
+// Limit returns output unchanged if it fits within the inline limit.
+// Otherwise it stores the full output and returns its head and tail around a
+// summary naming the ID to read the rest with. A nil store never truncates.
+func (s *OutputStore) Limit(ctx context.Context, output string, command, host string) string {
+	if s == nil || s.limit <= 0 || len(output) <= s.limit {
+		return output
+	}
+
+	id := s.put(ctx, output, command, host)
+
+	// Keep more of the tail than the head: that is where build failures and
+	// summaries end up.
+	head := cutHead(output, s.limit/3)
+	tail := cutTail(output, s.limit-len(head))
+	omitted := output[len(head) : len(output)-len(tail)]
+
+	return fmt.Sprintf("%s\n... [output truncated: %d of %d bytes (%d of %d lines) omitted. "+
+		"Full output stored as output_id=%q; use zopen_output_read to page through it.] ...\n%s",
+		head, len(omitted), len(output), strings.Count(omitted, "\n"), countLines(output), id, tail)
+}
+
+// Excerpt returns excerpt, lines first to last of output chosen by the
+// caller, with a note naming the ID the full output is stored under. Like
+// Limit, it returns output unchanged if truncation is disabled.
+func (s *OutputStore) Excerpt(ctx context.Context, output, excerpt string, first, last int, command, host string) string {
+	if s == nil || s.limit <= 0 {
+		return output
+	}
+	if first <= 1 && last >= countLines(output) {
+		return s.Limit(ctx, output, command, host)
+	}
+
+	id := s.put(ctx, output, command, host)
+	return fmt.Sprintf("... [showing lines %d-%d of %d. Full output stored as output_id=%q; use zopen_output_read to page through it.] ...\n%s",
+		first, last, countLines(output), id, cutTail(excerpt, s.limit))
+}
+
+// put stores text for the session of ctx and returns its ID, evicting the
+// oldest entries to stay within capacity.
+func (s *OutputStore) put(ctx context.Context, text, command, host string) string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	id := "out-" + hex.EncodeToString(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.order) > 0 && s.size+len(text) > outputStoreCapacity {
+		oldest := s.order[0]
+		s.order = s.order[1:]
+		s.size -= len(s.entries[oldest].Text)
+		delete(s.entries, oldest)
+	}
+	s.entries[id] = &storedOutput{ID: id, Session: outputSession(ctx), Command: command, Host: host, Created: time.Now(), Text: text}
+	s.order = append(s.order, id)
+	s.size += len(text)
+	return id
+}
+
+// Get returns the stored output with the given ID, if it belongs to the
+// session of ctx.
+func (s *OutputStore) Get(ctx context.Context, id string) (*storedOutput, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out, ok := s.entries[id]
+	if !ok || out.Session != outputSession(ctx) {
+		return nil, false
+	}
+	return out, true
+}
+
+// cutHead returns a prefix of s of at most n bytes, ending at a line break
+// when there is one, and never splitting a UTF-8 sequence.
+func cutHead(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	head := s[:n]
+	if i := strings.LastIndexByte(head, '\n'); i >= 0 {
+		return head[:i+1]
+	}
+	return s[:runeStart(s, n)]
+}
+
+// cutTail returns a suffix of s of at most n bytes, starting after a line
+// break when there is one, and never splitting a UTF-8 sequence.
+func cutTail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	tail := s[len(s)-n:]
+	if i := strings.IndexByte(tail, '\n'); i >= 0 && i < len(tail)-1 {
+		return tail[i+1:]
+	}
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	return tail
+}
+
+// runeStart moves offset i in s back to the start of the UTF-8 sequence it
+// falls in. Invalid bytes count as sequences of their own.
+func runeStart(s string, i int) int {
+	if i >= len(s) {
+		return i
+	}
+	for j := i; j >= 0 && j > i-utf8.UTFMax; j-- {
+		if utf8.RuneStart(s[j]) {
+			if r, size := utf8.DecodeRuneInString(s[j:]); r != utf8.RuneError || size > 1 {
+				if j+size > i {
+					return j
+				}
+			}
+			break
+		}
+	}
+	return i
+}
+
+// countLines counts lines, including a final line without a newline.
+func countLines(s string) int {
+	n := strings.Count(s, "\n")
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		n++
+	}
+	return n
+}
+
+// --- ZopenOutputRead Tool ---
+type ZopenOutputReadParams struct {
+	OutputID  string `json:"output_id"`
+	Offset    int    `json:"offset,omitempty"`
+	Length    int    `json:"length,omitempty"`
+	StartLine int    `json:"start_line,omitempty"`
+	LineCount int    `json:"line_count,omitempty"`
+}
+
+// ZopenOutputRead pages through a stored output, either by byte offset and
+// length or, when start_line is given, by 1-based line number and count.
+func (t *ZopenTools) ZopenOutputRead(ctx context.Context, req *mcp.CallToolRequest, args ZopenOutputReadParams) (*mcp.CallToolResult, any, error) {
+	out, ok := t.Outputs.Get(ctx, args.OutputID)
+	if !ok {
+		return commandToolResult(ctx, t.Outputs, nil, validationError("no stored output with output_id %q (it may have been evicted)", args.OutputID))
+	}
+
+	var header, page string
+	if args.StartLine > 0 {
+		count := args.LineCount
+		if count <= 0 {
+			count = defaultReadLines
+		}
+		lines := strings.SplitAfter(out.Text, "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		start := min(args.StartLine-1, len(lines))
+		end := min(start+count, len(lines))
+		page = strings.Join(lines[start:end], "")
+		header = fmt.Sprintf("[%s: lines %d-%d of %d", out.ID, start+1, end, len(lines))
+		if end < len(lines) {
+			header += fmt.Sprintf("; next start_line=%d", end+1)
+		}
+	} else {
+		length := args.Length
+		if length <= 0 {
+			length = defaultReadBytes
+		}
+		// Pages start and end on character boundaries, so each is valid
+		// text; a page always holds at least one character.
+		start := runeStart(out.Text, min(max(args.Offset, 0), len(out.Text)))
+		end := min(start+length, len(out.Text))
+		if end < len(out.Text) {
+			end = runeStart(out.Text, end)
+		}
+		if end == start && end < len(out.Text) {
+			_, size := utf8.DecodeRuneInString(out.Text[start:])
+			end = start + size
+		}
+		page = out.Text[start:end]
+		header = fmt.Sprintf("[%s: bytes %d-%d of %d", out.ID, start, end, len(out.Text))
+		if end < len(out.Text) {
+			header += fmt.Sprintf("; next offset=%d", end)
+		}
+	}
+	header += fmt.Sprintf("; command: %s on %s]", out.Command, out.Host)
+
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: header + "\n" + page}},
+		IsError: false,
+	}, nil, nil
+}
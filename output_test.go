@@ -0,0 +1,122 @@
+// output_test.go
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// storedID returns the output_id named in a truncated output.
+func storedID(t *testing.T, output string) string {
+	t.Helper()
+	m := regexp.MustCompile(`output_id="([^"]+)"`).FindStringSubmatch(output)
+	if m == nil {
+		t.Fatalf("no output_id in %q", output)
+	}
+	return m[1]
+}
+
+func TestOutputStoreLimit(t *testing.T) {
+	s := NewOutputStore(100)
+	ctx := context.Background()
+	if got := s.Limit(ctx, "short\n", "zopen list", "local"); got != "short\n" {
+		t.Errorf("Limit of short output = %q", got)
+	}
+
+	output := strings.Repeat("line of build output\n", 50)
+	got := s.Limit(ctx, output, "zopen build", "local")
+	if !strings.Contains(got, "output truncated") {
+		t.Fatalf("Limit did not truncate: %q", got)
+	}
+	out, ok := s.Get(ctx, storedID(t, got))
+	if !ok || out.Text != output {
+		t.Errorf("stored output = %v, %v; want the full output", out, ok)
+	}
+}
+
+func TestOutputStoreIsPerSession(t *testing.T) {
+	s := NewOutputStore(10)
+	alice := withOutputSession(context.Background(), new(mcp.ServerSession))
+	bob := withOutputSession(context.Background(), new(mcp.ServerSession))
+
+	id := storedID(t, s.Limit(alice, strings.Repeat("secret\n", 10), "zopen build", "zos1"))
+	if _, ok := s.Get(alice, id); !ok {
+		t.Error("session cannot read its own output")
+	}
+	if _, ok := s.Get(bob, id); ok {
+		t.Error("another session can read the output")
+	}
+	if _, ok := s.Get(context.Background(), id); ok {
+		t.Error("a call without a session can read the output")
+	}
+}
+
+func TestOutputReadKeepsCharactersWhole(t *testing.T) {
+	tools := &ZopenTools{Outputs: NewOutputStore(10)}
+	ctx := context.Background()
+	text := strings.Repeat("é漢字🙂x", 20)
+	id := storedID(t, tools.Outputs.Limit(ctx, text, "zopen build", "local"))
+
+	// Page through with a length that cuts into characters, from an offset
+	// inside one.
+	var pages strings.Builder
+	for offset := 1; offset < len(text); {
+		result, _, _ := tools.ZopenOutputRead(ctx, nil, ZopenOutputReadParams{OutputID: id, Offset: offset, Length: 5})
+		header, page, _ := strings.Cut(result.Content[0].(*mcp.TextContent).Text, "\n")
+		if !utf8.ValidString(page) {
+			t.Fatalf("page at offset %d is not valid UTF-8: %q", offset, page)
+		}
+		pages.WriteString(page)
+		m := regexp.MustCompile(`next offset=(\d+)`).FindStringSubmatch(header)
+		if m == nil {
+			break
+		}
+		offset, _ = strconv.Atoi(m[1])
+	}
+	// Offset 1 falls inside "é", so reading starts with it.
+	if pages.String() != text {
+		t.Errorf("pages joined to %q, want %q", pages.String(), text)
+	}
+}
+
+func TestRuneStart(t *testing.T) {
+	s := "aé漢\xffb"
+	tests := []struct{ i, want int }{
+		{0, 0}, {1, 1}, {2, 1}, {3, 3}, {4, 3}, {5, 3}, {6, 6}, {7, 7}, {8, 8},
+	}
+	for _, tt := range tests {
+		if got := runeStart(s, tt.i); got != tt.want {
+			t.Errorf("runeStart(%q, %d) = %d, want %d", s, tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestCutHeadTail(t *testing.T) {
+	s := "first\nsecond\nthird\n"
+	if got := cutHead(s, 10); got != "first\n" {
+		t.Errorf("cutHead = %q", got)
+	}
+	if got := cutTail(s, 10); got != "third\n" {
+		t.Errorf("cutTail = %q", got)
+	}
+	if got := cutHead("漢字", 4); got != "漢" {
+		t.Errorf("cutHead split a character: %q", got)
+	}
+	if got := cutTail("漢字", 4); got != "字" {
+		t.Errorf("cutTail split a character: %q", got)
+	}
+	// Stray bytes of undecoded EBCDIC earlier in the output must not make
+	// the whole head invalid.
+	if got := cutHead("\xc1\xc2 ok 漢字", 9); got != "\xc1\xc2 ok 漢" {
+		t.Errorf("cutHead with invalid bytes = %q", got)
+	}
+	if got := cutHead("\xc1\xc2 ok 漢字", 8); got != "\xc1\xc2 ok " {
+		t.Errorf("cutHead with invalid bytes split a character: %q", got)
+	}
+}
@@ -0,0 +1,470 @@
+// packages.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// --- Package Listings ---
+
+// PackageRecord is one package in a zopen package listing.
+type PackageRecord struct {
+	Name             string `json:"name" jsonschema:"package name"`
+	InstalledVersion string `json:"installed_version,omitempty" jsonschema:"installed version, if the package is installed"`
+	LatestVersion    string `json:"latest_version,omitempty" jsonschema:"latest version available from zopen community"`
+	Installed        bool   `json:"installed" jsonschema:"whether the package is installed"`
+	Outdated         bool   `json:"outdated" jsonschema:"whether a different version than the installed one is available"`
+	ReleaseLine      string `json:"release_line,omitempty" jsonschema:"release line the package comes from, e.g. STABLE or DEV"`
+}
+
+// packageColumn is the field a column of a package listing fills in.
+type packageColumn int
+
+const (
+	columnUnknown packageColumn = iota
+	columnName
+	columnInstalled
+	columnLatest
+	columnLatestTag // only used when there is no better latest version column
+	columnReleaseLine
+)
+
+// packageColumnNames maps normalized header labels to columns: zopen list
+// and zopen query print "Package", "Installed", "Available", "Latest Tag"
+// and "Release Line".
+var packageColumnNames = map[string]packageColumn{
+	"package":     columnName,
+	"installed":   columnInstalled,
+	"available":   columnLatest,
+	"latesttag":   columnLatestTag,
+	"releaseline": columnReleaseLine,
+}
+
+// columnSeparator splits a header into labels, which may contain single
+// spaces ("Release Line").
+var columnSeparator = regexp.MustCompile(`\s{2,}|\t`)
+
+// tableColumn is a column located in a header line.
+type tableColumn struct {
+	field packageColumn
+	start int
+}
+
+// parsePackageTable parses the table printed by zopen list and zopen query
+// into records. Columns are located by their header rather than assumed, so
+// reordered or additional columns do not break parsing; unknown columns are
+// ignored. It returns nil if the output has no recognizable table.
+func parsePackageTable(output string) []PackageRecord {
+	lines := strings.Split(stripANSI(output), "\n")
+	header, columns := -1, []tableColumn(nil)
+	for i, line := range lines {
+		if columns = parseTableHeader(line); columns != nil {
+			header = i
+			break
+		}
+	}
+	if header < 0 {
+		return nil
+	}
+
+	var records []PackageRecord
+	for _, line := range lines[header+1:] {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" && records != nil {
+			// The table ends at the first blank line; what follows is a
+			// summary or hint, not more packages.
+			break
+		}
+		if strings.TrimSpace(line) == "" || strings.Trim(line, "-=_ ") == "" {
+			continue
+		}
+		values := splitTableRow(line, columns)
+		record, ok := packageRecord(columns, values)
+		if ok {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// parseTableHeader returns the columns of a package table header line, or nil
+// if line is not one.
+func parseTableHeader(line string) []tableColumn {
+	trimmed := strings.TrimSpace(strings.TrimRight(line, "\r"))
+	labels := columnSeparator.Split(trimmed, -1)
+	if len(labels) < 2 {
+		// Some versions separate the labels by a single space.
+		labels = strings.Fields(trimmed)
+	}
+	if len(labels) < 2 || packageColumnNames[normalizeLabel(labels[0])] != columnName {
+		return nil
+	}
+
+	var columns []tableColumn
+	offset := 0
+	for _, label := range labels {
+		i := strings.Index(line[offset:], label)
+		if i < 0 {
+			return nil
+		}
+		columns = append(columns, tableColumn{field: packageColumnNames[normalizeLabel(label)], start: offset + i})
+		offset += i + len(label)
+	}
+	return columns
+}
+
+// normalizeLabel lowercases a header label and drops spaces, dashes and
+// underscores, so "Release Line" and "release_line" compare equal.
+func normalizeLabel(label string) string {
+	return strings.NewReplacer(" ", "", "-", "", "_", "", ":", "").Replace(strings.ToLower(label))
+}
+
+// splitTableRow splits a row into one value per column. Rows with a value in
+// every column are split on whitespace, which tolerates values wider than
+// their column; rows with empty cells, such as a package that is not
+// installed, are cut at the header's column positions.
+func splitTableRow(line string, columns []tableColumn) []string {
+	if fields := strings.Fields(line); len(fields) == len(columns) {
+		return fields
+	}
+	values := make([]string, len(columns))
+	for i, c := range columns {
+		if c.start >= len(line) {
+			break
+		}
+		end := len(line)
+		if i+1 < len(columns) && columns[i+1].start < end {
+			end = columns[i+1].start
+		}
+		values[i] = strings.TrimSpace(line[c.start:end])
+	}
+	return values
+}
+
+// packageRecord builds a record from the values of a row.
+func packageRecord(columns []tableColumn, values []string) (PackageRecord, bool) {
+	var record PackageRecord
+	var tag string
+	for i, c := range columns {
+		value := cleanTableValue(values[i])
+		switch c.field {
+		case columnName:
+			record.Name = value
+		case columnInstalled:
+			record.InstalledVersion = value
+		case columnLatest:
+			record.LatestVersion = value
+		case columnLatestTag:
+			tag = value
+		case columnReleaseLine:
+			record.ReleaseLine = value
+		}
+	}
+	// A name with spaces is a message printed after the table, not a row.
+	if record.Name == "" || strings.ContainsAny(record.Name, " \t") {
+		return record, false
+	}
+	if record.LatestVersion == "" {
+		record.LatestVersion = tag
+	}
+	record.Installed = record.InstalledVersion != ""
+	record.Outdated = record.Installed && record.LatestVersion != "" &&
+		strings.TrimPrefix(record.InstalledVersion, "v") != strings.TrimPrefix(record.LatestVersion, "v")
+	return record, true
+}
+
+// cleanTableValue returns "" for the placeholders zopen prints in empty
+// cells, and strips markers around installed versions.
+func cleanTableValue(value string) string {
+	value = strings.Trim(strings.TrimSpace(value), "*()[]")
+	switch strings.ToLower(value) {
+	case "-", "--", "n/a", "na", "none", "not installed", "notinstalled":
+		return ""
+	}
+	return value
+}
+
+// --- Package Queries ---
+
+// PackageQueryRecord is the result of querying one package.
+type PackageQueryRecord struct {
+	Name             string `json:"name" jsonschema:"package name"`
+	Found            bool   `json:"found" jsonschema:"whether zopen knows the package; false for a name that matched nothing"`
+	InstalledVersion string `json:"installed_version,omitempty" jsonschema:"installed version, if the package is installed"`
+	LatestVersion    string `json:"latest_version,omitempty" jsonschema:"latest version available from zopen community"`
+	Installed        bool   `json:"installed" jsonschema:"whether the package is installed"`
+	Outdated         bool   `json:"outdated" jsonschema:"whether a different version than the installed one is available"`
+	ReleaseLine      string `json:"release_line,omitempty" jsonschema:"release line the package comes from, e.g. STABLE or DEV"`
+}
+
+// queryRecords matches the packages found by zopen query against the ones
+// requested, in the order they were requested, with a not-found record for
+// each one zopen did not list. With no packages requested, every listed
+// package is returned.
+func queryRecords(requested []string, found []PackageRecord) []PackageQueryRecord {
+	records := []PackageQueryRecord{}
+	if len(requested) == 0 {
+		for _, p := range found {
+			records = append(records, queryRecord(p))
+		}
+		return records
+	}
+	for _, name := range requested {
+		record := PackageQueryRecord{Name: name}
+		for _, p := range found {
+			if samePackage(name, p.Name) {
+				record = queryRecord(p)
+				break
+			}
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func queryRecord(p PackageRecord) PackageQueryRecord {
+	return PackageQueryRecord{
+		Name:             p.Name,
+		Found:            true,
+		InstalledVersion: p.InstalledVersion,
+		LatestVersion:    p.LatestVersion,
+		Installed:        p.Installed,
+		Outdated:         p.Outdated,
+		ReleaseLine:      p.ReleaseLine,
+	}
+}
+
+// samePackage reports whether a requested package name refers to a listed
+// package. Port repositories are named after the package with a "port"
+// suffix, so "bashport" may be requested for bash.
+func samePackage(requested, listed string) bool {
+	return requested == listed || strings.TrimSuffix(requested, "port") == listed
+}
+
+// --- Package Info ---
+
+// PackageInfo is the detailed information zopen info prints about a package.
+type PackageInfo struct {
+	Name          string     `json:"name" jsonschema:"package name"`
+	Found         bool       `json:"found" jsonschema:"whether zopen printed information about the package"`
+	Version       string     `json:"version,omitempty" jsonschema:"installed version; empty if the package is not installed"`
+	Release       string     `json:"release,omitempty" jsonschema:"release line of the package"`
+	Dependencies  []string   `json:"dependencies" jsonschema:"names of the packages this package depends on"`
+	InstallPath   string     `json:"install_path,omitempty" jsonschema:"directory the package is installed in"`
+	Size          string     `json:"size,omitempty" jsonschema:"size of the package, as zopen printed it"`
+	License       string     `json:"license,omitempty" jsonschema:"license of the package"`
+	RepositoryURL string     `json:"repository_url,omitempty" jsonschema:"URL of the package's source repository"`
+	Error         *ToolError `json:"error,omitempty" jsonschema:"why the call failed"`
+}
+
+// infoField is the field of PackageInfo a line of zopen info fills in.
+type infoField int
+
+const (
+	infoUnknown infoField = iota
+	infoName
+	infoVersion
+	infoRelease
+	infoDependencies
+	infoInstallPath
+	infoSize
+	infoLicense
+	infoRepository
+)
+
+// infoFieldNames maps the normalized labels zopen info prints, as in
+// testdata/zopen-info-*.txt, to fields. Other labels are ignored.
+var infoFieldNames = map[string]infoField{
+	"package":             infoName,
+	"installedversion":    infoVersion,
+	"releaseline":         infoRelease,
+	"dependencies":        infoDependencies,
+	"runtimedependencies": infoDependencies,
+	"installpath":         infoInstallPath,
+	"size":                infoSize,
+	"license":             infoLicense,
+	"repository":          infoRepository,
+}
+
+// infoLine matches a "Label: value" line of zopen info output.
+var infoLine = regexp.MustCompile(`^\s*([A-Za-z][A-Za-z _-]{0,40}?)\s*:\s*(.*)$`)
+
+// listItem matches an item of a list printed below its label.
+var listItem = regexp.MustCompile(`^\s+(?:[-*]\s*)?(\S.*)$|^[-*]\s+(\S.*)$`)
+
+// parsePackageInfo parses the output of zopen info for the named package.
+// Lines zopen prints that are not recognized are ignored, and Found is false
+// if none were.
+func parsePackageInfo(name, output string) *PackageInfo {
+	info := &PackageInfo{Name: name, Dependencies: []string{}}
+	inDependencies := false
+	for _, line := range strings.Split(stripANSI(output), "\n") {
+		line = strings.TrimRight(line, "\r")
+		m := infoLine.FindStringSubmatch(line)
+		field := infoUnknown
+		if m != nil {
+			field = infoFieldNames[normalizeLabel(m[1])]
+		}
+		if field == infoUnknown {
+			// Dependencies may be listed one per line below their label.
+			if item := listItem.FindStringSubmatch(line); inDependencies && item != nil {
+				info.Dependencies = append(info.Dependencies, splitDependencies(item[1]+item[2])...)
+			} else {
+				inDependencies = false
+			}
+			continue
+		}
+
+		inDependencies = false
+		value := cleanTableValue(m[2])
+		info.Found = true
+		switch field {
+		case infoName:
+			if value != "" {
+				info.Name = value
+			}
+		case infoVersion:
+			info.Version = value
+		case infoRelease:
+			info.Release = value
+		case infoDependencies:
+			info.Dependencies = append(info.Dependencies, splitDependencies(value)...)
+			inDependencies = value == ""
+		case infoInstallPath:
+			info.InstallPath = value
+		case infoSize:
+			info.Size = value
+		case infoLicense:
+			info.License = value
+		case infoRepository:
+			info.RepositoryURL = value
+		}
+	}
+	return info
+}
+
+// dependencyConstraint matches a version constraint after a dependency name,
+// such as "(>= 3.1)" or ">=3.1".
+var dependencyConstraint = regexp.MustCompile(`\s*(\(.*?\)|[<>=]=?\s*\S+)`)
+
+// splitDependencies splits a list of dependencies, separated by commas or
+// spaces, into package names.
+func splitDependencies(value string) []string {
+	value = dependencyConstraint.ReplaceAllString(value, "")
+	var names []string
+	for _, name := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '|'
+	}) {
+		if name = cleanTableValue(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// --- Package Changes ---
+
+// PackageVersion is a package at a particular version.
+type PackageVersion struct {
+	Name    string `json:"name" jsonschema:"package name"`
+	Version string `json:"version" jsonschema:"package version"`
+}
+
+// PackageChange is a package whose installed version changed.
+type PackageChange struct {
+	Name string `json:"name" jsonschema:"package name"`
+	From string `json:"from" jsonschema:"version installed before the call"`
+	To   string `json:"to" jsonschema:"version installed after the call"`
+}
+
+// PackageDiff is what a call changed in the set of installed packages.
+type PackageDiff struct {
+	Added    []PackageVersion `json:"added" jsonschema:"packages that were installed"`
+	Removed  []PackageVersion `json:"removed" jsonschema:"packages that were removed"`
+	Upgraded []PackageChange  `json:"upgraded" jsonschema:"packages whose installed version changed"`
+	Switched []PackageChange  `json:"switched" jsonschema:"packages whose active version was switched with zopen alt"`
+}
+
+// snapshotTimeout bounds each listing of the installed packages taken around
+// a change. The listing after a change also runs when the change itself
+// timed out or was cancelled, so that a partial change is still reported.
+const snapshotTimeout = 2 * time.Minute
+
+// snapshotPackages returns the installed packages on target, by name, as
+// seen with env.
+func snapshotPackages(ctx context.Context, target *Target, env map[string]string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), snapshotTimeout)
+	defer cancel()
+	res, err := runReadOnly(ctx, target, Command{Program: target.ZopenBinary(), Args: []string{"list"}, Env: env})
+	if err != nil {
+		return nil, err
+	}
+	if res.ExitCode != 0 {
+		return nil, fmt.Errorf("zopen list exited with code %d", res.ExitCode)
+	}
+	records := parsePackageTable(res.Stdout)
+	if records == nil {
+		return nil, fmt.Errorf("no package table in the output of zopen list")
+	}
+	installed := make(map[string]string)
+	for _, r := range records {
+		if r.Installed {
+			installed[r.Name] = r.InstalledVersion
+		}
+	}
+	return installed, nil
+}
+
+// diffPackages compares two snapshots of the installed packages. Version
+// changes count as switches for zopen alt and as upgrades otherwise.
+func diffPackages(before, after map[string]string, switching bool) *PackageDiff {
+	diff := &PackageDiff{
+		Added:    []PackageVersion{},
+		Removed:  []PackageVersion{},
+		Upgraded: []PackageChange{},
+		Switched: []PackageChange{},
+	}
+	for _, name := range sortedKeys(after) {
+		from, ok := before[name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, PackageVersion{Name: name, Version: after[name]})
+		case from == after[name]:
+		case switching:
+			diff.Switched = append(diff.Switched, PackageChange{Name: name, From: from, To: after[name]})
+		default:
+			diff.Upgraded = append(diff.Upgraded, PackageChange{Name: name, From: from, To: after[name]})
+		}
+	}
+	for _, name := range sortedKeys(before) {
+		if _, ok := after[name]; !ok {
+			diff.Removed = append(diff.Removed, PackageVersion{Name: name, Version: before[name]})
+		}
+	}
+	return diff
+}
+
+// String summarizes the diff for the text of a tool result.
+func (d *PackageDiff) String() string {
+	var changes []string
+	for _, p := range d.Added {
+		changes = append(changes, fmt.Sprintf("added %s %s", p.Name, p.Version))
+	}
+	for _, p := range d.Removed {
+		changes = append(changes, fmt.Sprintf("removed %s %s", p.Name, p.Version))
+	}
+	for _, c := range d.Upgraded {
+		changes = append(changes, fmt.Sprintf("upgraded %s %s → %s", c.Name, c.From, c.To))
+	}
+	for _, c := range d.Switched {
+		changes = append(changes, fmt.Sprintf("switched %s %s → %s", c.Name, c.From, c.To))
+	}
+	if len(changes) == 0 {
+		return "none"
+	}
+	return strings.Join(changes, "; ")
+}
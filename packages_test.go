@@ -0,0 +1,197 @@
+// packages_test.go
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readTestdata returns the contents of a file in testdata.
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParsePackageTable(t *testing.T) {
+	bash := PackageRecord{Name: "bash", InstalledVersion: "5.2.21", LatestVersion: "5.2.21", Installed: true, ReleaseLine: "STABLE"}
+	curl := PackageRecord{Name: "curl", InstalledVersion: "8.4.0", LatestVersion: "8.6.0", Installed: true, Outdated: true, ReleaseLine: "STABLE"}
+	gnulib := PackageRecord{Name: "gnulib", LatestVersion: "2024.01", ReleaseLine: "DEV"}
+	jq := PackageRecord{Name: "jq", LatestVersion: "1.7.1", ReleaseLine: "STABLE"}
+	git := PackageRecord{Name: "git", InstalledVersion: "2.43.0", LatestVersion: "2.43.0", Installed: true, ReleaseLine: "STABLE"}
+	gnuMake := PackageRecord{Name: "make", InstalledVersion: "4.4.1", LatestVersion: "4.4.1", Installed: true, ReleaseLine: "STABLE"}
+	zlib := PackageRecord{Name: "zlib", InstalledVersion: "1.3", LatestVersion: "1.3.1", Installed: true, Outdated: true, ReleaseLine: "STABLE"}
+
+	tests := []struct {
+		file string
+		want []PackageRecord
+	}{
+		{"zopen-list.txt", []PackageRecord{bash, curl, git, gnulib, jq, gnuMake, zlib}},
+		{"zopen-list-verbose.txt", []PackageRecord{bash, curl, gnulib, zlib}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got := parsePackageTable(readTestdata(t, tt.file))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d packages, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("package %d:\n got %+v\nwant %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePackageTableWithoutTable(t *testing.T) {
+	for _, output := range []string{
+		"",
+		"No packages installed\n",
+		"Package bash is not installed\n",
+		"Type     Installed\nbash     5.2.21\n",
+	} {
+		if got := parsePackageTable(output); got != nil {
+			t.Errorf("parsePackageTable(%q) = %+v, want nil", output, got)
+		}
+	}
+}
+
+func TestDiffPackages(t *testing.T) {
+	before := map[string]string{"bash": "5.2.21", "curl": "8.4.0", "jq": "1.7.1"}
+	after := map[string]string{"bash": "5.2.21", "curl": "8.6.0", "zlib": "1.3.1"}
+
+	got := diffPackages(before, after, false)
+	want := &PackageDiff{
+		Added:    []PackageVersion{{Name: "zlib", Version: "1.3.1"}},
+		Removed:  []PackageVersion{{Name: "jq", Version: "1.7.1"}},
+		Upgraded: []PackageChange{{Name: "curl", From: "8.4.0", To: "8.6.0"}},
+		Switched: []PackageChange{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffPackages = %+v, want %+v", got, want)
+	}
+	if s := got.String(); s != "added zlib 1.3.1; removed jq 1.7.1; upgraded curl 8.4.0 → 8.6.0" {
+		t.Errorf("String() = %q", s)
+	}
+
+	got = diffPackages(before, map[string]string{"bash": "5.2.15", "curl": "8.4.0", "jq": "1.7.1"}, true)
+	if len(got.Switched) != 1 || len(got.Upgraded) != 0 || got.Switched[0].To != "5.2.15" {
+		t.Errorf("zopen alt diff = %+v", got)
+	}
+	if s := diffPackages(before, before, false).String(); s != "none" {
+		t.Errorf("empty diff String() = %q", s)
+	}
+}
+
+func TestSamePackage(t *testing.T) {
+	tests := []struct {
+		requested, listed string
+		want              bool
+	}{
+		{"bash", "bash", true},
+		{"bashport", "bash", true},
+		{"bash", "bashport", false},
+		{"Bash", "bash", false},
+		{"zlibport", "zlib", true},
+		{"make", "gmake", false},
+		{"sport", "s", true},
+		{"sport", "sport", true},
+	}
+	for _, tt := range tests {
+		if got := samePackage(tt.requested, tt.listed); got != tt.want {
+			t.Errorf("samePackage(%q, %q) = %v, want %v", tt.requested, tt.listed, got, tt.want)
+		}
+	}
+}
+
+func TestZopenQuery(t *testing.T) {
+	output := readTestdata(t, "zopen-query.txt")
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		// zopen query exits non-zero when a package is not found, but still
+		// lists the others.
+		return &CommandResult{Command: cmd.String(), Host: "fake", Stdout: output, ExitCode: 1,
+			Stderr: "Package nosuchpkg not found\n"}, nil
+	}}
+	tools := &ZopenTools{
+		Config:  &Config{Targets: map[string]*Target{"local": {Name: "local", Exec: fake}}, DefaultTarget: "local"},
+		Outputs: NewOutputStore(defaultMaxOutputBytes),
+	}
+
+	_, out, err := tools.ZopenQuery(context.Background(), nil, ZopenQueryParams{Packages: []string{"curlport", "nosuchpkg", "jq", "Bash"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PackageQueryRecord{
+		{Name: "curl", Found: true, InstalledVersion: "8.4.0", LatestVersion: "8.6.0", Installed: true, Outdated: true, ReleaseLine: "STABLE"},
+		{Name: "nosuchpkg"},
+		{Name: "jq", Found: true, LatestVersion: "1.7.1", ReleaseLine: "STABLE"},
+		{Name: "Bash"},
+	}
+	if !reflect.DeepEqual(out.Packages, want) {
+		t.Errorf("packages:\n got %+v\nwant %+v", out.Packages, want)
+	}
+	if calls := fake.Calls(); len(calls) != 1 || !reflect.DeepEqual(calls[0].Args, []string{"query", "curlport", "nosuchpkg", "jq", "Bash"}) {
+		t.Errorf("ran %+v", calls)
+	}
+
+	// Without packages, every listed one is returned.
+	_, out, _ = tools.ZopenQuery(context.Background(), nil, ZopenQueryParams{})
+	if len(out.Packages) != 3 || !out.Packages[0].Found {
+		t.Errorf("query of everything = %+v", out.Packages)
+	}
+}
+
+func TestParsePackageInfo(t *testing.T) {
+	tests := []struct {
+		file string
+		want *PackageInfo
+	}{
+		{"zopen-info-curl.txt", &PackageInfo{
+			Name:          "curl",
+			Found:         true,
+			Version:       "8.4.0",
+			Release:       "STABLE",
+			Dependencies:  []string{"openssl", "zlib", "libpsl"},
+			InstallPath:   "/u/ibmuser/zopen/usr/local/zopen/curl/curl-8.4.0",
+			Size:          "14.2 MB",
+			License:       "curl",
+			RepositoryURL: "https://github.com/zopencommunity/curlport",
+		}},
+		{"zopen-info-jq.txt", &PackageInfo{
+			// Not installed: no version and no install path.
+			Name:          "jq",
+			Found:         true,
+			Release:       "STABLE",
+			Dependencies:  []string{"oniguruma", "libtool"},
+			Size:          "1.1 MB",
+			License:       "MIT",
+			RepositoryURL: "https://github.com/zopencommunity/jqport",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got := parsePackageInfo(tt.want.Name, readTestdata(t, tt.file))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePackageInfo:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+
+	got := parsePackageInfo("nosuchpkg", "Package nosuchpkg not found in the zopen community\n")
+	if got.Found || got.Name != "nosuchpkg" || len(got.Dependencies) != 0 {
+		t.Errorf("info of a missing package = %+v", got)
+	}
+
+	// Labels zopen info does not print are not taken for fields.
+	got = parsePackageInfo("curl", "Version: 8.6.0\nLocation: /tmp\nRequires: openssl\n")
+	if got.Found || got.Version != "" || got.InstallPath != "" || len(got.Dependencies) != 0 {
+		t.Errorf("info with unknown labels = %+v", got)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+// proc_other.go
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op on platforms without process groups; the
+// default cancellation kills only the direct child.
+func setProcessGroup(c *exec.Cmd) (waited func()) { return func() {} }
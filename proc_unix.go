@@ -0,0 +1,46 @@
+//go:build unix
+
+// proc_unix.go
+package main
+
+import (
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// killGrace is how long a cancelled process group gets between SIGTERM and
+// SIGKILL.
+const killGrace = 5 * time.Second
+
+// setProcessGroup starts c in its own process group and makes cancellation
+// terminate the whole group, so processes spawned by zopen (compilers, make,
+// configure scripts) stop along with it. The returned function must be
+// called once c.Wait has returned. The group outlives its leader while any
+// child that ignored SIGTERM is still running, so the function sends the
+// SIGKILL right away in that case; once the group is empty it only stops the
+// pending SIGKILL, since the group ID may be reused.
+func setProcessGroup(c *exec.Cmd) (waited func()) {
+	var kill atomic.Pointer[time.Timer]
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		pgid := -c.Process.Pid
+		err := syscall.Kill(pgid, syscall.SIGTERM)
+		kill.Store(time.AfterFunc(killGrace, func() { syscall.Kill(pgid, syscall.SIGKILL) }))
+		return err
+	}
+	// Children that keep the output pipes open hold up Wait until
+	// WaitDelay, after the SIGKILL has gone out.
+	c.WaitDelay = killGrace + time.Second
+	return func() {
+		t := kill.Load()
+		if t == nil || !t.Stop() {
+			return
+		}
+		pgid := -c.Process.Pid
+		if syscall.Kill(pgid, 0) != syscall.ESRCH {
+			syscall.Kill(pgid, syscall.SIGKILL)
+		}
+	}
+}
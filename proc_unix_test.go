@@ -0,0 +1,93 @@
+//go:build unix
+
+// proc_unix_test.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processAlive reports whether process pid is running. A zombie waiting to
+// be reaped, which is all a killed orphan is until init gets to it, does not
+// count.
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	// The state follows the parenthesized command name.
+	if i := bytes.LastIndexByte(stat, ')'); i >= 0 && i+2 < len(stat) {
+		return stat[i+2] != 'Z'
+	}
+	return true
+}
+
+func TestLocalExecutorCancelKillsProcessGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	// The shell reports the PID of a child it starts in the background;
+	// cancelling must stop the child as well as the shell.
+	pids := make(chan int, 1)
+	cmd := Command{Program: "/bin/sh", Args: []string{"-c", `sleep 60 & echo $!; wait`}, OnLine: func(line string, stderr bool) {
+		if pid, err := strconv.Atoi(line); err == nil {
+			pids <- pid
+		}
+	}}
+	_, err := (&LocalExecutor{}).Run(ctx, cmd)
+	var cancelled *CancelledError
+	if !errors.As(err, &cancelled) || !cancelled.TimedOut {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	pid := <-pids
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("background child %d survived the cancelled command", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLocalExecutorCancelKillsChildIgnoringSIGTERM(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	// The child ignores SIGTERM and does not hold the output pipes, so Wait
+	// returns as soon as the shell is gone while the child keeps the group
+	// alive. It must be killed then, not left running.
+	pids := make(chan int, 1)
+	cmd := Command{Program: "/bin/sh", Args: []string{"-c", `sh -c "trap '' TERM; sleep 60" >/dev/null 2>&1 & echo $!; wait`}, OnLine: func(line string, stderr bool) {
+		if pid, err := strconv.Atoi(line); err == nil {
+			pids <- pid
+		}
+	}}
+	start := time.Now()
+	_, err := (&LocalExecutor{}).Run(ctx, cmd)
+	var cancelled *CancelledError
+	if !errors.As(err, &cancelled) || !cancelled.TimedOut {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	pid := <-pids
+	deadline := start.Add(killGrace / 2)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("child %d ignoring SIGTERM survived the cancelled command", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
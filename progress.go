@@ -0,0 +1,208 @@
+// progress.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// --- Progress Notifications ---
+
+// progressQueueSize bounds the notifications waiting to be sent. When a slow
+// client lets more pile up, the oldest are dropped.
+const progressQueueSize = 256
+
+// progressDrainTimeout bounds how long notifications still queued when the
+// tool call ends are given to reach the client.
+const progressDrainTimeout = time.Second
+
+// ProgressReporter forwards command output to the client as MCP progress
+// notifications, one per line, tagged with the phase the command is in.
+// Notifications are queued and sent by a separate goroutine, so a slow
+// client never holds up the command's output.
+type ProgressReporter struct {
+	ctx    context.Context
+	notify func(context.Context, *mcp.ProgressNotificationParams) error
+	token  any
+	wake   chan struct{}
+
+	mu       sync.Mutex
+	progress float64
+	phase    string
+	queue    []*mcp.ProgressNotificationParams
+	dropped  int // notifications dropped since the last one sent
+}
+
+// NewProgressReporter returns a reporter for req, or nil if the client did
+// not ask for progress by sending a progress token. A nil reporter is valid
+// and discards everything. Notifications stop when ctx is done.
+func NewProgressReporter(ctx context.Context, req *mcp.CallToolRequest) *ProgressReporter {
+	if req == nil || req.Session == nil || req.Params == nil {
+		return nil
+	}
+	token := req.Params.GetProgressToken()
+	if token == nil {
+		return nil
+	}
+	return newProgressReporter(ctx, req.Session.NotifyProgress, token)
+}
+
+// newProgressReporter returns a reporter that sends its notifications with
+// notify.
+func newProgressReporter(ctx context.Context, notify func(context.Context, *mcp.ProgressNotificationParams) error, token any) *ProgressReporter {
+	p := &ProgressReporter{ctx: ctx, notify: notify, token: token, wake: make(chan struct{}, 1)}
+	go p.send()
+	return p
+}
+
+// Line reports one line of output. It is safe for concurrent use by the
+// stdout and stderr streams of a command.
+func (p *ProgressReporter) Line(line string, stderr bool) {
+	if p == nil {
+		return
+	}
+	line = strings.TrimRight(stripANSI(line), "\r")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if phase := detectPhase(line); phase != "" {
+		p.phase = phase
+	}
+
+	message := line
+	if stderr {
+		message = "stderr: " + message
+	}
+	if p.phase != "" {
+		message = fmt.Sprintf("[%s] %s", p.phase, message)
+	}
+	p.enqueue(message)
+}
+
+// Status reports a message about the tool call itself, such as waiting for
+// its turn, rather than a line of command output.
+func (p *ProgressReporter) Status(message string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enqueue(message)
+}
+
+// enqueue queues a notification with the next progress value, dropping the
+// oldest queued one if the queue is full. p.mu must be held.
+func (p *ProgressReporter) enqueue(message string) {
+	p.progress++
+	if len(p.queue) == progressQueueSize {
+		p.queue = p.queue[1:]
+		p.dropped++
+	}
+	p.queue = append(p.queue, &mcp.ProgressNotificationParams{
+		ProgressToken: p.token,
+		Progress:      p.progress,
+		Message:       message,
+	})
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send delivers queued notifications until ctx is done, then drains what is
+// left so the last lines of output are not lost. The first one sent after
+// some were dropped says how many.
+func (p *ProgressReporter) send() {
+	for {
+		select {
+		case <-p.ctx.Done():
+			// The call is over, but its final lines are often the ones
+			// that matter; give the client a moment to receive them.
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(p.ctx), progressDrainTimeout)
+			defer cancel()
+			p.flush(ctx)
+			return
+		case <-p.wake:
+		}
+		p.flush(p.ctx)
+	}
+}
+
+// flush sends the queued notifications with ctx. If ctx is done first, the
+// unsent ones go back to the front of the queue.
+func (p *ProgressReporter) flush(ctx context.Context) {
+	p.mu.Lock()
+	queue, dropped := p.queue, p.dropped
+	p.queue, p.dropped = nil, 0
+	p.mu.Unlock()
+
+	for i, params := range queue {
+		if ctx.Err() != nil {
+			p.requeue(queue[i:], dropped)
+			return
+		}
+		if dropped > 0 {
+			params.Message = fmt.Sprintf("[%d lines skipped] %s", dropped, params.Message)
+			dropped = 0
+		}
+		// Notifications are best effort; a client that stopped
+		// listening must not fail the command.
+		_ = p.notify(ctx, params)
+	}
+}
+
+// requeue puts unsent notifications, and the count of those dropped before
+// them, back in front of the ones queued since.
+func (p *ProgressReporter) requeue(unsent []*mcp.ProgressNotificationParams, dropped int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = append(unsent, p.queue...)
+	p.dropped += dropped
+	if excess := len(p.queue) - progressQueueSize; excess > 0 {
+		p.queue = p.queue[excess:]
+		p.dropped += excess
+	}
+}
+
+// ansiEscape matches terminal color and cursor sequences zopen emits.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// stripANSI removes terminal escape sequences from s.
+func stripANSI(s string) string {
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+// phasePatterns maps zopen's progress messages to the phase they announce.
+// They are checked in order, so more specific patterns come first.
+var phasePatterns = []struct {
+	phase   string
+	pattern *regexp.Regexp
+}{
+	{"check", regexp.MustCompile(`(?i)^\W*(running (the )?(check|tests?)|checking results|zopen_check_results|running make (check|test))`)},
+	{"install", regexp.MustCompile(`(?i)^\W*(running (make )?install|installing|installed|extracting|activating|unpacking)`)},
+	{"patch", regexp.MustCompile(`(?i)^\W*(applying (patch|\S+\.(patch|diff)\b)|patching)`)},
+	{"bootstrap", regexp.MustCompile(`(?i)^\W*(running (the )?(bootstrap|autogen|autoreconf)|bootstrapping)`)},
+	{"configure", regexp.MustCompile(`(?i)^\W*(running (the )?(configure|cmake)|configuring|checking (for|whether|how|if) )`)},
+	{"build", regexp.MustCompile(`(?i)^\W*(running (make|build|gmake|ninja)|building|compiling|make(\[\d+\])?: entering)`)},
+	{"download", regexp.MustCompile(`(?i)^\W*(downloading|fetching|cloning|retrieving|getting)`)},
+}
+
+// detectPhase returns the phase announced by line, or "" if the line does
+// not mark a phase change.
+func detectPhase(line string) string {
+	for _, p := range phasePatterns {
+		if p.pattern.MatchString(line) {
+			return p.phase
+		}
+	}
+	return ""
+}
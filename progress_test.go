@@ -0,0 +1,151 @@
+// progress_test.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestProgressReporterDoesNotBlockOnSlowClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The client takes the first notification and then stalls until
+	// released.
+	sent := make(chan *mcp.ProgressNotificationParams, 2*progressQueueSize)
+	release := make(chan struct{})
+	stalled := false
+	notify := func(ctx context.Context, params *mcp.ProgressNotificationParams) error {
+		sent <- params
+		if !stalled {
+			stalled = true
+			<-release
+		}
+		return nil
+	}
+	p := newProgressReporter(ctx, notify, "build-1")
+
+	p.Line("Building zlib", false)
+	first := <-sent
+	if first.Message != "[build] Building zlib" || first.ProgressToken != "build-1" {
+		t.Fatalf("first notification = %+v", first)
+	}
+
+	done := make(chan struct{})
+	const lines = 3 * progressQueueSize
+	go func() {
+		for i := 0; i < lines; i++ {
+			p.Line("compiling", false)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Line blocked behind a stalled client")
+	}
+	close(release)
+
+	var got []*mcp.ProgressNotificationParams
+	for len(got) < progressQueueSize {
+		select {
+		case params := <-sent:
+			got = append(got, params)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d notifications after the client caught up, want %d", len(got), progressQueueSize)
+		}
+	}
+	skipped := lines - progressQueueSize
+	if want := fmt.Sprintf("[%d lines skipped] [build] compiling", skipped); got[0].Message != want {
+		t.Errorf("first notification after the stall = %q, want %q", got[0].Message, want)
+	}
+	last := first.Progress
+	for _, params := range got {
+		if params.Progress <= last {
+			t.Errorf("progress went from %v to %v", last, params.Progress)
+		}
+		last = params.Progress
+	}
+	if last != lines+1 {
+		t.Errorf("last progress = %v, want %d", last, lines+1)
+	}
+}
+
+func TestProgressReporterDrainsQueueWhenDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The client stalls on the first notification while the command writes
+	// its last lines and the tool call ends.
+	sent := make(chan string, 10)
+	release := make(chan struct{})
+	notify := func(ctx context.Context, params *mcp.ProgressNotificationParams) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		sent <- params.Message
+		if params.Progress == 1 {
+			<-release
+		}
+		return nil
+	}
+	p := newProgressReporter(ctx, notify, "build-1")
+	p.Line("Building zlib", false)
+	if got := <-sent; got != "[build] Building zlib" {
+		t.Fatalf("first notification = %q", got)
+	}
+	p.Line("Running make install", false)
+	p.Line("zlib installed", false)
+	cancel()
+	close(release)
+
+	for _, want := range []string{"[install] Running make install", "[install] zlib installed"} {
+		select {
+		case got := <-sent:
+			if got != want {
+				t.Errorf("notification = %q, want %q", got, want)
+			}
+		case <-time.After(2 * progressDrainTimeout):
+			t.Fatalf("%q was not sent after the call ended", want)
+		}
+	}
+}
+
+func TestProgressReporterNil(t *testing.T) {
+	var p *ProgressReporter
+	p.Line("Building zlib", false)
+	p.Status("waiting")
+	if NewProgressReporter(context.Background(), &mcp.CallToolRequest{}) != nil {
+		t.Error("NewProgressReporter without a session should return nil")
+	}
+}
+
+func TestDetectPhase(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"Downloading https://github.com/madler/zlib/archive/v1.3.tar.gz", "download"},
+		{"Applying patch patches/zos.patch", "patch"},
+		{"Running bootstrap", "bootstrap"},
+		{"checking for gcc... xlclang", "configure"},
+		{"Running make -j4", "build"},
+		{"make[1]: Entering directory '/u/user/zlib'", "build"},
+		{"Running make check", "check"},
+		{"Running make install", "install"},
+		{"zlib.c:12:3: warning: unused variable", ""},
+	}
+	for _, tt := range tests {
+		if got := detectPhase(stripANSI(tt.line)); got != tt.want {
+			t.Errorf("detectPhase(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+	if got := stripANSI("\x1b[32mInstalling\x1b[0m zlib"); !strings.HasPrefix(got, "Installing") {
+		t.Errorf("stripANSI left %q", got)
+	}
+}
@@ -0,0 +1,126 @@
+// proxy.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Jump Hosts and Proxy Commands ---
+
+// resolveJumps parses target.ProxyJump into the hosts to connect through,
+// in order. Each hop is looked up in ssh_config like the target itself;
+// settings it does not get from there are taken from the target, except
+// the user, which defaults to the local user as with ssh -J.
+func resolveJumps(target *Target, sshConfig *sshConfig) ([]*Target, error) {
+	if target.ProxyJump == "" {
+		return nil, nil
+	}
+	var jumps []*Target
+	for i, spec := range strings.Split(target.ProxyJump, ",") {
+		spec = strings.TrimPrefix(strings.TrimSpace(spec), "ssh://")
+		if spec == "" {
+			return nil, fmt.Errorf("target %s: empty jump host in %q", target.Name, target.ProxyJump)
+		}
+		hop, err := parseTarget(spec, spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := sshConfig.apply(hop); err != nil {
+			return nil, err
+		}
+		// Only the first hop is dialed directly, so only it can use a
+		// proxy command; nested jump chains are not followed.
+		hop.ProxyJump = ""
+		if i > 0 {
+			hop.ProxyCommand = ""
+		}
+		if hop.Key == "" {
+			hop.Key = target.Key
+		}
+		if hop.Port == 0 {
+			hop.Port = defaultSSHPort
+		}
+		if hop.ConnectTimeout == 0 {
+			hop.ConnectTimeout = target.ConnectTimeout
+		}
+		jumps = append(jumps, hop)
+	}
+	return jumps, nil
+}
+
+// expandProxyCommand returns target.ProxyCommand with %h, %p, %r and %%
+// expanded as in ssh_config.
+func expandProxyCommand(target *Target) string {
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", target.Host,
+		"%p", strconv.Itoa(target.Port),
+		"%r", target.User,
+	).Replace(target.ProxyCommand)
+}
+
+// dialProxyCommand starts target.ProxyCommand and returns a connection over
+// its stdin and stdout.
+func dialProxyCommand(target *Target) (net.Conn, error) {
+	cmd := exec.Command("/bin/sh", "-c", expandProxyCommand(target))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start proxy command: %w", err)
+	}
+	return &proxyConn{cmd: cmd, r: stdout, w: stdin, addr: proxyAddr(sshAddr(target))}, nil
+}
+
+// proxyConn is a net.Conn over the stdin and stdout of a proxy command.
+// Deadlines are not supported; dialHop bounds the handshake by closing the
+// connection instead.
+type proxyConn struct {
+	cmd  *exec.Cmd
+	r    io.ReadCloser
+	w    io.WriteCloser
+	addr proxyAddr
+
+	closeOnce sync.Once
+}
+
+func (c *proxyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *proxyConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// Close stops the proxy command.
+func (c *proxyConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.w.Close()
+		c.r.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *proxyConn) LocalAddr() net.Addr                { return c.addr }
+func (c *proxyConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *proxyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *proxyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *proxyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// proxyAddr is the address of the host a proxy command connects to. Host key
+// checks look at the remote address, so it must be a host:port.
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "proxy-command" }
+func (a proxyAddr) String() string  { return string(a) }
@@ -0,0 +1,175 @@
+// proxy_test.go
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandProxyCommand(t *testing.T) {
+	target := &Target{Host: "zos.example.com", Port: 2222, User: "ibmuser"}
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"nc %h %p", "nc zos.example.com 2222"},
+		{"ssh -W %h:%p %r@bastion", "ssh -W zos.example.com:2222 ibmuser@bastion"},
+		{"corkscrew proxy 8080 %h %p", "corkscrew proxy 8080 zos.example.com 2222"},
+		{"echo 100%%", "echo 100%"},
+		{"echo %%h %%%h", "echo %h %zos.example.com"},
+		{"printf %s %d", "printf %s %d"},
+		{"no tokens", "no tokens"},
+		{"%h%h", "zos.example.comzos.example.com"},
+	}
+	for _, tt := range tests {
+		target.ProxyCommand = tt.command
+		if got := expandProxyCommand(target); got != tt.want {
+			t.Errorf("expandProxyCommand(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestResolveJumps(t *testing.T) {
+	config := writeSSHConfig(t, `
+Host bastion
+    HostName bastion.example.com
+    User jumper
+    Port 2200
+    ProxyCommand nc -X connect -x proxy:8080 %h %p
+
+Host inner
+    HostName 10.1.1.1
+    ProxyCommand nc %h %p
+`)
+	target := &Target{
+		Name:           "zos",
+		Host:           "zos.example.com",
+		Key:            "~/.ssh/zos",
+		ConnectTimeout: 7 * time.Second,
+		ProxyJump:      "bastion, ssh://admin@inner:2022",
+	}
+	jumps, err := resolveJumps(target, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jumps) != 2 {
+		t.Fatalf("got %d jump hosts, want 2", len(jumps))
+	}
+	first, second := jumps[0], jumps[1]
+	if first.Host != "bastion.example.com" || first.User != "jumper" || first.Port != 2200 {
+		t.Errorf("first hop = %s@%s:%d", first.User, first.Host, first.Port)
+	}
+	if first.ProxyCommand == "" {
+		t.Error("first hop lost its proxy command")
+	}
+	if second.Host != "10.1.1.1" || second.User != "admin" || second.Port != 2022 {
+		t.Errorf("second hop = %s@%s:%d", second.User, second.Host, second.Port)
+	}
+	if second.ProxyCommand != "" {
+		t.Error("second hop kept a proxy command, but it is reached through the first")
+	}
+	for _, hop := range jumps {
+		if hop.Key != target.Key || hop.ConnectTimeout != target.ConnectTimeout {
+			t.Errorf("hop %s did not inherit key and connect timeout: %q %s", hop.Host, hop.Key, hop.ConnectTimeout)
+		}
+	}
+
+	target.ProxyJump = "bastion,,inner"
+	if _, err := resolveJumps(target, config); err == nil {
+		t.Error("resolveJumps accepted an empty jump host")
+	}
+}
+
+func TestSSHExecutorThroughJumpHosts(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	first := startTestSSHServer(t, signer.PublicKey())
+	second := startTestSSHServer(t, signer.PublicKey())
+	dest := startTestSSHServer(t, signer.PublicKey())
+
+	target := dest.target(keyFile)
+	target.Jumps = []*Target{first.target(keyFile), second.target(keyFile)}
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+
+	res, err := NewSSHExecutor(target, pool).Run(context.Background(), Command{Program: "echo", Args: []string{"hello"}})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Stdout != "hello\n" {
+		t.Errorf("stdout = %q, want %q", res.Stdout, "hello\n")
+	}
+	if first.forwards.Load() != 1 || second.forwards.Load() != 1 {
+		t.Errorf("jump hosts forwarded %d and %d connections, want 1 each", first.forwards.Load(), second.forwards.Load())
+	}
+	if dest.connections.Load() != 1 || dest.forwards.Load() != 0 {
+		t.Errorf("destination saw %d connections and %d forwards, want 1 and 0", dest.connections.Load(), dest.forwards.Load())
+	}
+}
+
+func TestSSHExecutorJumpHostDown(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	jump := startTestSSHServer(t, signer.PublicKey())
+	dest := startTestSSHServer(t, signer.PublicKey())
+
+	target := dest.target(keyFile)
+	hop := jump.target(keyFile)
+	hop.User = "nobody"
+	target.Jumps = []*Target{hop}
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+
+	_, err := NewSSHExecutor(target, pool).Run(context.Background(), Command{Program: "true"})
+	if err == nil || !strings.Contains(err.Error(), "jump host") {
+		t.Fatalf("Run through a jump host that rejects us: %v", err)
+	}
+	if code := classifyError(nil, err); code != CodeAuth {
+		t.Errorf("error code = %s, want %s", code, CodeAuth)
+	}
+	if dest.connections.Load() != 0 {
+		t.Error("destination was reached without the jump host")
+	}
+}
+
+// proxyHelperEnv makes the test binary act as a proxy command, relaying
+// stdin and stdout to the address in its last two arguments.
+const proxyHelperEnv = "ZOPEN_MCP_TEST_PROXY"
+
+func TestProxyCommandHelper(t *testing.T) {
+	if os.Getenv(proxyHelperEnv) == "" {
+		t.Skip("only runs as a proxy command")
+	}
+	args := os.Args[len(os.Args)-2:]
+	conn, err := net.Dial("tcp", net.JoinHostPort(args[0], args[1]))
+	if err != nil {
+		os.Exit(1)
+	}
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestSSHExecutorThroughProxyCommand(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+
+	target := srv.target(keyFile)
+	target.ProxyCommand = proxyHelperEnv + "=1 " + shellQuote(os.Args[0]) + " -test.run='^TestProxyCommandHelper$' %h %p"
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+
+	res, err := NewSSHExecutor(target, pool).Run(context.Background(), Command{Program: "echo", Args: []string{"proxied"}})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Stdout != "proxied\n" {
+		t.Errorf("stdout = %q, want %q", res.Stdout, "proxied\n")
+	}
+}
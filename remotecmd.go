@@ -0,0 +1,110 @@
+// remotecmd.go
+package main
+
+import (
+	"strings"
+)
+
+// --- Remote Command Construction ---
+
+// RemoteCommand describes a command to run on the remote system. Every
+// caller-supplied value (environment, directory, program and arguments) is quoted, so no
+// part of it is ever interpreted by the remote shell.
+type RemoteCommand struct {
+	Bootstrap string            // trusted shell snippet run first, e.g. ". ~/.profile"
+	Env       map[string]string // variables exported after the bootstrap
+	Dir       string            // directory to change into before running Program
+	Program   string            // program to run, e.g. "zopen"
+	Args      []string          // arguments passed to Program
+}
+
+// Check rejects a command the remote shell could not receive intact: no
+// shell word can hold a NUL byte, and the remote side would cut the script
+// short at the first one.
+func (c *RemoteCommand) Check() error {
+	values := append([]string{c.Dir, c.Program}, c.Args...)
+	for name, value := range c.Env {
+		values = append(values, name, value)
+	}
+	for _, v := range values {
+		if strings.IndexByte(v, 0) >= 0 {
+			return validationError("arguments, directory and environment cannot contain NUL bytes")
+		}
+	}
+	return nil
+}
+
+// Script returns the shell script executed by the remote /bin/sh.
+func (c *RemoteCommand) Script() string {
+	var steps []string
+	if c.Bootstrap != "" {
+		steps = append(steps, c.Bootstrap)
+	}
+	// After the bootstrap, so that a profile cannot override them.
+	if exports := exportScript(c.Env); exports != "" {
+		steps = append(steps, exports)
+	}
+	if c.Dir != "" {
+		steps = append(steps, "cd -- "+quoteRemotePath(c.Dir))
+	}
+
+	words := make([]string, 0, len(c.Args)+1)
+	words = append(words, shellQuote(c.Program))
+	for _, arg := range c.Args {
+		words = append(words, shellQuote(arg))
+	}
+	steps = append(steps, strings.Join(words, " "))
+
+	return strings.Join(steps, " && ")
+}
+
+// String returns the command line sent over SSH. The script is wrapped in
+// /bin/sh -c so it runs under a POSIX shell regardless of the user's login
+// shell.
+func (c *RemoteCommand) String() string {
+	return "/bin/sh -c " + shellQuote(c.Script())
+}
+
+// shellQuote quotes s so a POSIX shell treats it as a single literal word.
+// Strings made only of characters that are never special are left as is for
+// readability; everything else is wrapped in single quotes, with embedded
+// single quotes closed, escaped and reopened.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if isShellSafe(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// isShellSafe reports whether s contains only characters that carry no
+// meaning to the shell.
+func isShellSafe(s string) bool {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("-_./:,+@%", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// quoteRemotePath quotes a directory for the remote shell. A leading "~/" is
+// kept outside the quotes as "$HOME" so paths relative to the remote user's
+// home directory still resolve.
+func quoteRemotePath(dir string) string {
+	if dir == "~" {
+		return `"$HOME"`
+	}
+	if rest, ok := strings.CutPrefix(dir, "~/"); ok {
+		if rest == "" {
+			return `"$HOME"`
+		}
+		return `"$HOME"/` + shellQuote(rest)
+	}
+	return shellQuote(dir)
+}
@@ -0,0 +1,143 @@
+// remotecmd_test.go
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// shellWords are inputs that are special to the shell in one way or another.
+var shellWords = []string{
+	"",
+	"plain",
+	"~",
+	"~/",
+	"~root",
+	"a b",
+	"'",
+	"''",
+	`"`,
+	`it's "quoted"`,
+	`'\''`,
+	"$HOME",
+	"${HOME}",
+	"`id`",
+	"$(id)",
+	"; rm -rf /",
+	"a && b || c",
+	"*",
+	"?",
+	"[a-z]",
+	"#comment",
+	"line1\nline2",
+	"\n",
+	"tab\there",
+	"back\\slash",
+	"!event",
+	"-n",
+	"--",
+	"=",
+	"\xff\xfe not UTF-8",
+	"é ü 漢字",
+}
+
+// shellOutput runs script with the local /bin/sh and returns its stdout.
+func shellOutput(t *testing.T, script string, env ...string) string {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Env = append([]string{"PATH=/usr/bin:/bin"}, env...)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("/bin/sh -c %q: %v", script, err)
+	}
+	return string(out)
+}
+
+func FuzzShellQuote(f *testing.F) {
+	for _, s := range shellWords {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		if strings.IndexByte(s, 0) >= 0 {
+			// No shell word can hold a NUL; RemoteCommand.Check rejects them.
+			t.Skip()
+		}
+		if got := shellOutput(t, "printf %s "+shellQuote(s)); got != s {
+			t.Errorf("round trip of %q through the shell gave %q", s, got)
+		}
+	})
+}
+
+func TestShellQuoteSingleWord(t *testing.T) {
+	// Each quoted input must stay one word, whatever follows it.
+	for _, s := range shellWords {
+		got := shellOutput(t, `for w in `+shellQuote(s)+`; do printf '<%s>' "$w"; done`)
+		if want := "<" + s + ">"; got != want {
+			t.Errorf("shellQuote(%q) split into %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestQuoteRemotePath(t *testing.T) {
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{"~", "/home/tester"},
+		{"~/", "/home/tester"},
+		{"~/src/zlib port", "/home/tester/src/zlib port"},
+		{"~/it's", "/home/tester/it's"},
+		{"~/$(id)", "/home/tester/$(id)"},
+		{"~root", "~root"},
+		{"/u/ibmuser/~", "/u/ibmuser/~"},
+		{"/tmp/a;b", "/tmp/a;b"},
+		{"rel/dir", "rel/dir"},
+	}
+	for _, tt := range tests {
+		got := shellOutput(t, "printf %s "+quoteRemotePath(tt.dir), "HOME=/home/tester")
+		if got != tt.want {
+			t.Errorf("quoteRemotePath(%q) expanded to %q, want %q", tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteCommandScript(t *testing.T) {
+	dir := t.TempDir()
+	cmd := &RemoteCommand{
+		Env:     map[string]string{"ZOPEN_ROOT": `$(id) "quoted" it's`, "CFLAGS": "-O2 -g"},
+		Dir:     dir,
+		Program: "/bin/sh",
+		Args: append([]string{"-c", `printf '%s\n' "$PWD" "$ZOPEN_ROOT" "$CFLAGS"; printf '[%s]' "$@"`, "sh"},
+			shellWords...),
+	}
+	if err := cmd.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	// String is what is sent over SSH; the remote side runs it with a shell.
+	got := shellOutput(t, cmd.String())
+	want := dir + "\n" + `$(id) "quoted" it's` + "\n-O2 -g\n"
+	for _, w := range shellWords {
+		want += "[" + w + "]"
+	}
+	if got != want {
+		t.Errorf("remote command printed\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestRemoteCommandRejectsNUL(t *testing.T) {
+	tests := []*RemoteCommand{
+		{Program: "zopen", Args: []string{"install", "bash\x00; id"}},
+		{Program: "zopen\x00", Args: []string{"list"}},
+		{Program: "zopen", Dir: "/tmp\x00/x"},
+		{Program: "zopen", Env: map[string]string{"CC": "xlc\x00"}},
+	}
+	for _, cmd := range tests {
+		var validationErr *ValidationError
+		if err := cmd.Check(); !errors.As(err, &validationErr) {
+			t.Errorf("Check(%q %q) = %v, want a validation error", cmd.Program, cmd.Args, err)
+		}
+	}
+}
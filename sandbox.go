@@ -0,0 +1,398 @@
+// sandbox.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// --- Sandboxes ---
+
+const (
+	// defaultSandboxDir is where sandbox roots are created on a target.
+	defaultSandboxDir = "~/.zopen-mcp/sandboxes"
+
+	// defaultSandboxTTL is how long a sandbox lives unless the call that
+	// creates it asks otherwise.
+	defaultSandboxTTL = 2 * time.Hour
+
+	// sandboxGCInterval is how often expired sandboxes are removed.
+	sandboxGCInterval = 5 * time.Minute
+
+	// sandboxGCTimeout bounds each removal run by the garbage collector.
+	sandboxGCTimeout = 5 * time.Minute
+)
+
+// Sandbox is a throwaway zopen root on a target, for trying packages without
+// touching the target's shared zopen installation.
+type Sandbox struct {
+	ID      string
+	Target  *Target
+	Root    string // path of the zopen root on the target
+	Created time.Time
+	Expires time.Time
+}
+
+// Config returns the shell snippet that activates the sandbox's environment.
+func (s *Sandbox) Config() string {
+	return ". " + quoteRemotePath(s.Root) + "/etc/zopen-config"
+}
+
+// SandboxStore keeps track of the sandboxes created by this server and removes
+// them once they expire. Each sandbox's expiry time is also recorded next to
+// its root on the target, so sandboxes left behind by an earlier run of the
+// server are cleaned up too.
+type SandboxStore struct {
+	dir string
+	ttl time.Duration
+
+	mu        sync.Mutex
+	sandboxes map[string]*Sandbox
+	swept     map[*Target]bool // targets cleaned of stale sandboxes
+}
+
+// NewSandboxStore creates a store for sandboxes under dir on each target,
+// living for ttl by default.
+func NewSandboxStore(dir string, ttl time.Duration) *SandboxStore {
+	return &SandboxStore{
+		dir:       strings.TrimSuffix(dir, "/"),
+		ttl:       ttl,
+		sandboxes: make(map[string]*Sandbox),
+		swept:     make(map[*Target]bool),
+	}
+}
+
+// Get returns the sandbox with the given ID.
+func (s *SandboxStore) Get(id string) (*Sandbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sb, ok := s.sandboxes[id]
+	if !ok {
+		return nil, validationError("no sandbox with sandbox_id %q (it may have expired)", id)
+	}
+	return sb, nil
+}
+
+// List returns the live sandboxes, oldest first.
+func (s *SandboxStore) List() []*Sandbox {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*Sandbox, 0, len(s.sandboxes))
+	for _, sb := range s.sandboxes {
+		list = append(list, sb)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Create initializes a new zopen root on target, running zopen init with env,
+// that expires after ttl, or the store's default TTL if ttl is zero. The result is the output of
+// zopen init; the sandbox is only kept if it succeeded.
+func (s *SandboxStore) Create(ctx context.Context, target *Target, ttl time.Duration, env map[string]string) (*Sandbox, *CommandResult, error) {
+	if ttl <= 0 {
+		ttl = s.ttl
+	}
+	s.sweep(ctx, target)
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate sandbox ID: %w", err)
+	}
+	now := time.Now()
+	sb := &Sandbox{
+		ID:      "sb-" + hex.EncodeToString(buf),
+		Target:  target,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+	sb.Root = s.dir + "/" + sb.ID
+
+	root := quoteRemotePath(sb.Root)
+	script := fmt.Sprintf("mkdir -p %s && echo %d > %s && %s init --yes %s",
+		root, sb.Expires.Unix(), s.marker(sb.ID), shellQuote(target.ZopenBinary()), root)
+	res, err := target.Exec.Run(ctx, Command{Program: "/bin/sh", Args: []string{"-c", script}, Env: env})
+	if err != nil || res.ExitCode != 0 {
+		s.remove(context.WithoutCancel(ctx), target, sb.ID)
+		return nil, res, err
+	}
+
+	s.mu.Lock()
+	s.sandboxes[sb.ID] = sb
+	s.mu.Unlock()
+	return sb, res, nil
+}
+
+// Run runs a shell command in the sandbox's environment with env set on top,
+// in directory or the sandbox root. Output is streamed to progress, which may be nil.
+func (s *SandboxStore) Run(ctx context.Context, sb *Sandbox, command, directory string, env map[string]string, progress *ProgressReporter) (*CommandResult, error) {
+	if directory == "" {
+		directory = sb.Root
+	}
+	script := fmt.Sprintf("%s && cd -- %s && %s", sb.Config(), quoteRemotePath(directory), command)
+	cmd := Command{Program: "/bin/sh", Args: []string{"-c", script}, Env: env}
+	if progress != nil {
+		cmd.OnLine = progress.Line
+	}
+	return sb.Target.Exec.Run(ctx, cmd)
+}
+
+// Destroy removes the sandbox from its target.
+func (s *SandboxStore) Destroy(ctx context.Context, sb *Sandbox) (*CommandResult, error) {
+	res, err := s.remove(ctx, sb.Target, sb.ID)
+	if err == nil && res.ExitCode == 0 {
+		s.mu.Lock()
+		delete(s.sandboxes, sb.ID)
+		s.mu.Unlock()
+	}
+	return res, err
+}
+
+// remove deletes the root and expiry marker of sandbox id on target.
+func (s *SandboxStore) remove(ctx context.Context, target *Target, id string) (*CommandResult, error) {
+	script := fmt.Sprintf("rm -rf %s %s", quoteRemotePath(s.dir+"/"+id), s.marker(id))
+	return target.Exec.Run(ctx, Command{Program: "/bin/sh", Args: []string{"-c", script}})
+}
+
+// marker returns the quoted path of the file recording when sandbox id
+// expires. It is kept beside the root rather than in it, so zopen init sees
+// an empty directory.
+func (s *SandboxStore) marker(id string) string {
+	return quoteRemotePath(s.dir + "/" + id + ".expires")
+}
+
+// Start removes expired sandboxes periodically until ctx is done.
+func (s *SandboxStore) Start(ctx context.Context) {
+	ticker := time.NewTicker(sandboxGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.collect(ctx)
+		}
+	}
+}
+
+// collect removes the sandboxes that have expired.
+func (s *SandboxStore) collect(ctx context.Context) {
+	now := time.Now()
+	var expired []*Sandbox
+	s.mu.Lock()
+	for _, sb := range s.sandboxes {
+		if now.After(sb.Expires) {
+			expired = append(expired, sb)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sb := range expired {
+		ctx, cancel := context.WithTimeout(ctx, sandboxGCTimeout)
+		res, err := s.Destroy(ctx, sb)
+		cancel()
+		if err == nil && res.ExitCode != 0 {
+			err = fmt.Errorf("%s", strings.TrimSpace(res.Output()))
+		}
+		if err != nil {
+			log.Printf("Warning: failed to remove expired sandbox %s on target %s: %v", sb.ID, sb.Target.Name, err)
+		} else if os.Getenv("DEBUG") != "" {
+			log.Printf("Removed expired sandbox %s on target %s", sb.ID, sb.Target.Name)
+		}
+	}
+}
+
+// sweep removes expired sandboxes left on target by earlier runs of the
+// server, the first time a sandbox is created there. If the sandboxes cannot
+// be listed, the sweep is tried again with the next sandbox.
+func (s *SandboxStore) sweep(ctx context.Context, target *Target) {
+	s.mu.Lock()
+	swept := s.swept[target]
+	s.mu.Unlock()
+	if swept {
+		return
+	}
+
+	// List each marker with its expiry time; the comparison is done here
+	// because not every date(1) on z/OS can print the epoch.
+	script := fmt.Sprintf(`cd %s 2>/dev/null || exit 0
+for f in sb-*.expires; do [ -f "$f" ] && echo "${f%%.expires} $(cat "$f")"; done; exit 0`, quoteRemotePath(s.dir))
+	res, err := target.Exec.Run(ctx, Command{Program: "/bin/sh", Args: []string{"-c", script}})
+	if err != nil || res.ExitCode != 0 {
+		return
+	}
+	s.mu.Lock()
+	s.swept[target] = true
+	s.mu.Unlock()
+
+	now := time.Now().Unix()
+	for _, line := range strings.Split(res.Stdout, "\n") {
+		id, expires, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		if t, err := strconv.ParseInt(expires, 10, 64); err != nil || t > now {
+			continue
+		}
+		if _, err := s.remove(ctx, target, id); err != nil {
+			log.Printf("Warning: failed to remove stale sandbox %s on target %s: %v", id, target.Name, err)
+		} else if os.Getenv("DEBUG") != "" {
+			log.Printf("Removed stale sandbox %s on target %s", id, target.Name)
+		}
+	}
+}
+
+// describe summarizes a sandbox for tool results.
+func (sb *Sandbox) describe() string {
+	return fmt.Sprintf("%s on target %s at %s (expires in %s)",
+		sb.ID, sb.Target.Name, sb.Root, time.Until(sb.Expires).Round(time.Minute))
+}
+
+// --- ZopenSandboxCreate Tool ---
+type ZopenSandboxCreateParams struct {
+	TTLMinutes     int               `json:"ttl_minutes,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+func (t *ZopenTools) ZopenSandboxCreate(ctx context.Context, req *mcp.CallToolRequest, args ZopenSandboxCreateParams) (*mcp.CallToolResult, any, error) {
+	target, err := t.Config.Target(args.Target)
+	if err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	if err := t.Config.CheckEnv(args.Env); err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	sb, res, err := t.Sandboxes.Create(ctx, target, time.Duration(args.TTLMinutes)*time.Minute, args.Env)
+	if sb == nil {
+		return commandToolResult(ctx, t.Outputs, res, err)
+	}
+	res.Stdout = fmt.Sprintf("Created sandbox %s.\nUse sandbox_id=%q with zopen_sandbox_install and zopen_sandbox_run.\n\n%s",
+		sb.describe(), sb.ID, res.Stdout)
+	return commandToolResult(ctx, t.Outputs, res, nil)
+}
+
+// --- ZopenSandboxInstall Tool ---
+type ZopenSandboxInstallParams struct {
+	SandboxID      string            `json:"sandbox_id"`
+	Packages       []string          `json:"packages"`
+	Verbose        bool              `json:"verbose"`
+	Env            map[string]string `json:"env,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+func (t *ZopenTools) ZopenSandboxInstall(ctx context.Context, req *mcp.CallToolRequest, args ZopenSandboxInstallParams) (*mcp.CallToolResult, any, error) {
+	sb, err := t.Sandboxes.Get(args.SandboxID)
+	if err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	if err := t.Config.CheckEnv(args.Env); err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	if err := checkPackageNames(args.Packages); err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	words := []string{"zopen", "install", "--yes"}
+	if args.Verbose {
+		words = append(words, "--verbose")
+	}
+	for _, pkg := range args.Packages {
+		words = append(words, shellQuote(pkg))
+	}
+	// The zopen found on the sandbox's PATH is the one zopen init set up
+	// in it, so packages are installed into the sandbox.
+	res, err := t.Sandboxes.Run(ctx, sb, strings.Join(words, " "), "", args.Env, NewProgressReporter(ctx, req))
+	markPackageCommand(res, words[1:])
+	return commandToolResult(ctx, t.Outputs, res, err)
+}
+
+// checkPackageNames rejects an empty package list, and names that are empty
+// or would be taken for options by zopen.
+func checkPackageNames(packages []string) error {
+	if len(packages) == 0 {
+		return validationError("packages parameter is required")
+	}
+	for _, pkg := range packages {
+		if strings.TrimSpace(pkg) == "" {
+			return validationError("package names cannot be empty")
+		}
+		if strings.HasPrefix(pkg, "-") {
+			return validationError("invalid package name %q: package names cannot start with '-'", pkg)
+		}
+	}
+	return nil
+}
+
+// --- ZopenSandboxRun Tool ---
+type ZopenSandboxRunParams struct {
+	SandboxID      string            `json:"sandbox_id"`
+	Command        string            `json:"command"`
+	Directory      string            `json:"directory,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+func (t *ZopenTools) ZopenSandboxRun(ctx context.Context, req *mcp.CallToolRequest, args ZopenSandboxRunParams) (*mcp.CallToolResult, any, error) {
+	sb, err := t.Sandboxes.Get(args.SandboxID)
+	if err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	if err := t.Config.CheckEnv(args.Env); err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	if strings.TrimSpace(args.Command) == "" {
+		return commandToolResult(ctx, t.Outputs, nil, validationError("command parameter is required"))
+	}
+	res, err := t.Sandboxes.Run(ctx, sb, args.Command, args.Directory, args.Env, NewProgressReporter(ctx, req))
+	return commandToolResult(ctx, t.Outputs, res, err)
+}
+
+// --- ZopenSandboxDestroy Tool ---
+type ZopenSandboxDestroyParams struct {
+	SandboxID      string `json:"sandbox_id"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+}
+
+func (t *ZopenTools) ZopenSandboxDestroy(ctx context.Context, req *mcp.CallToolRequest, args ZopenSandboxDestroyParams) (*mcp.CallToolResult, any, error) {
+	sb, err := t.Sandboxes.Get(args.SandboxID)
+	if err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	res, err := t.Sandboxes.Destroy(ctx, sb)
+	if err == nil && res.ExitCode == 0 {
+		res.Stdout = fmt.Sprintf("Removed sandbox %s from target %s.\n%s", sb.ID, sb.Target.Name, res.Stdout)
+	}
+	return commandToolResult(ctx, t.Outputs, res, err)
+}
+
+// --- ZopenSandboxList Tool ---
+type ZopenSandboxListParams struct{}
+
+func (t *ZopenTools) ZopenSandboxList(ctx context.Context, req *mcp.CallToolRequest, args ZopenSandboxListParams) (*mcp.CallToolResult, any, error) {
+	list := t.Sandboxes.List()
+	if len(list) == 0 {
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{&mcp.TextContent{Text: "No sandboxes. Create one with zopen_sandbox_create."}},
+			IsError: false,
+		}, nil, nil
+	}
+	var b strings.Builder
+	for _, sb := range list {
+		fmt.Fprintf(&b, "%s\n", sb.describe())
+	}
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: b.String()}},
+		IsError: false,
+	}, nil, nil
+}
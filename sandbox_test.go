@@ -0,0 +1,116 @@
+// sandbox_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPackageNames(t *testing.T) {
+	tests := []struct {
+		packages []string
+		ok       bool
+	}{
+		{[]string{"curl"}, true},
+		{[]string{"curl", "git", "zlib-1.3"}, true},
+		{nil, false},
+		{[]string{}, false},
+		{[]string{""}, false},
+		{[]string{"curl", "  "}, false},
+		{[]string{"-y"}, false},
+		{[]string{"curl", "--all"}, false},
+	}
+	for _, tt := range tests {
+		err := checkPackageNames(tt.packages)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkPackageNames(%q) = %v, want ok=%v", tt.packages, err, tt.ok)
+		}
+		if err != nil && classifyError(nil, err) != CodeValidation {
+			t.Errorf("checkPackageNames(%q) error code = %s, want %s", tt.packages, classifyError(nil, err), CodeValidation)
+		}
+	}
+}
+
+func TestZopenSandboxInstall(t *testing.T) {
+	fake := &FakeExecutor{}
+	target := &Target{Name: "dev", Remote: true, Host: "dev.example.com", Exec: fake}
+	tools := &ZopenTools{
+		Config:    &Config{Targets: map[string]*Target{"dev": target}, DefaultTarget: "dev"},
+		Outputs:   NewOutputStore(defaultMaxOutputBytes),
+		Sandboxes: NewSandboxStore(defaultSandboxDir, time.Hour),
+	}
+	ctx := context.Background()
+
+	sb, _, err := tools.Sandboxes.Create(ctx, target, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^sb-[0-9a-f]{16}$`).MatchString(sb.ID) {
+		t.Errorf("sandbox ID %q is not 8 random bytes", sb.ID)
+	}
+
+	for _, packages := range [][]string{nil, {""}, {"-v"}, {"curl", "--force"}} {
+		before := len(fake.Calls())
+		result, _, _ := tools.ZopenSandboxInstall(ctx, nil, ZopenSandboxInstallParams{SandboxID: sb.ID, Packages: packages})
+		if !result.IsError {
+			t.Errorf("install of %q was accepted", packages)
+		}
+		if len(fake.Calls()) != before {
+			t.Errorf("install of %q ran a command", packages)
+		}
+	}
+
+	result, _, _ := tools.ZopenSandboxInstall(ctx, nil, ZopenSandboxInstallParams{SandboxID: sb.ID, Packages: []string{"curl", "git"}})
+	if result.IsError {
+		t.Fatalf("install failed: %+v", result.Content)
+	}
+	calls := fake.Calls()
+	script := calls[len(calls)-1].Args[1]
+	if !strings.HasSuffix(script, "zopen install --yes curl git") {
+		t.Errorf("install ran %q", script)
+	}
+}
+
+func TestSandboxSweepRetriesFailedListing(t *testing.T) {
+	listFails := true
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		script := cmd.Args[1]
+		if !strings.Contains(script, "sb-*.expires") {
+			return &CommandResult{Command: cmd.String()}, nil
+		}
+		if listFails {
+			return nil, connectionError(errors.New("connection reset"))
+		}
+		stdout := fmt.Sprintf("sb-expired %d\nsb-live %d\n", time.Now().Add(-time.Hour).Unix(), time.Now().Add(time.Hour).Unix())
+		return &CommandResult{Command: cmd.String(), Stdout: stdout}, nil
+	}}
+	target := &Target{Name: "dev", Remote: true, Exec: fake}
+	store := NewSandboxStore(defaultSandboxDir, time.Hour)
+	ctx := context.Background()
+
+	store.sweep(ctx, target)
+	if n := len(fake.Calls()); n != 1 {
+		t.Fatalf("failed sweep ran %d commands, want 1", n)
+	}
+
+	// The host is reachable again: the sweep was not done, so it runs.
+	listFails = false
+	store.sweep(ctx, target)
+	calls := fake.Calls()
+	if len(calls) != 3 {
+		t.Fatalf("sweep ran %d commands in all, want 3", len(calls))
+	}
+	if rm := calls[2].Args[1]; !strings.Contains(rm, "sb-expired") || strings.Contains(rm, "sb-live") {
+		t.Errorf("sweep ran %q, want only sb-expired removed", rm)
+	}
+
+	store.sweep(ctx, target)
+	if n := len(fake.Calls()); n != 3 {
+		t.Errorf("target was swept again: %d commands in all", n)
+	}
+}
@@ -0,0 +1,233 @@
+// scheduler.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// --- Per-Target Scheduling ---
+
+// TargetQueue serializes the tool calls that change a target, such as
+// installs and removals, which would otherwise fight over zopen's package
+// database. Calls are admitted in the order they arrive. Read-only calls do
+// not use the queue and run concurrently with everything else.
+type TargetQueue struct {
+	mu      sync.Mutex
+	busy    bool
+	running string    // description of the call holding the queue
+	waiting []*ticket // calls waiting their turn, oldest first
+	changed chan struct{}
+}
+
+// ticket is a call waiting in a TargetQueue.
+type ticket struct {
+	desc  string
+	ready chan struct{} // closed when the call is admitted
+}
+
+// Acquire waits until it is the caller's turn to change the target. While
+// waiting, onWait is called with the caller's position in the queue (1 is
+// next) and the call currently running, whenever the position changes. The
+// returned release function must be called when the change is done.
+func (q *TargetQueue) Acquire(ctx context.Context, desc string, onWait func(position int, running string)) (release func(), err error) {
+	q.mu.Lock()
+	if !q.busy && len(q.waiting) == 0 {
+		q.busy = true
+		q.running = desc
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	t := &ticket{desc: desc, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, t)
+	q.mu.Unlock()
+
+	last := 0
+	for {
+		q.mu.Lock()
+		position, running := q.position(t), q.running
+		changed := q.changedChan()
+		q.mu.Unlock()
+		if position == 0 {
+			return q.release, nil
+		}
+		if position != last {
+			onWait(position, running)
+			last = position
+		}
+
+		select {
+		case <-t.ready:
+			return q.release, nil
+		case <-changed:
+		case <-ctx.Done():
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			if q.position(t) == 0 {
+				// Admitted just as the call gave up: pass the turn on.
+				q.releaseLocked()
+			} else {
+				q.remove(t)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release admits the next waiting call, if any.
+func (q *TargetQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+func (q *TargetQueue) releaseLocked() {
+	if len(q.waiting) == 0 {
+		q.busy = false
+		q.running = ""
+	} else {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running = next.desc
+		close(next.ready)
+	}
+	q.notifyLocked()
+}
+
+// position returns t's place in the queue, or 0 if it has been admitted.
+func (q *TargetQueue) position(t *ticket) int {
+	for i, w := range q.waiting {
+		if w == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// remove drops a call that gave up waiting.
+func (q *TargetQueue) remove(t *ticket) {
+	if i := q.position(t); i > 0 {
+		q.waiting = append(q.waiting[:i-1], q.waiting[i:]...)
+		q.notifyLocked()
+	}
+}
+
+// changedChan returns a channel that is closed the next time the queue
+// changes.
+func (q *TargetQueue) changedChan() chan struct{} {
+	if q.changed == nil {
+		q.changed = make(chan struct{})
+	}
+	return q.changed
+}
+
+// notifyLocked wakes every waiting call so it can report its new position.
+func (q *TargetQueue) notifyLocked() {
+	if q.changed != nil {
+		close(q.changed)
+		q.changed = nil
+	}
+}
+
+// QueuedError reports that a call gave up while waiting for its turn, so the
+// command was never run.
+type QueuedError struct {
+	Command  string
+	Host     string
+	Elapsed  time.Duration
+	TimedOut bool
+}
+
+func (e *QueuedError) Error() string {
+	reason := "was cancelled by the client"
+	if e.TimedOut {
+		reason = "timed out"
+	}
+	return fmt.Sprintf("Command '%s' on %s %s after waiting %s for other changes to the target to finish; it was not run",
+		e.Command, e.Host, reason, e.Elapsed.Round(time.Millisecond))
+}
+
+// --- zopen Lock Handling ---
+
+// lockHeldPattern matches the messages zopen prints when another zopen
+// process, for example one started outside this server, holds its lock.
+var lockHeldPattern = regexp.MustCompile(`(?i)(could not|cannot|failed to|unable to) (obtain|acquire|get) (the )?lock|lock(file)? (is )?(already )?(held|in use|taken)|another (zopen )?(process|instance) is (running|using)`)
+
+const (
+	// lockRetries is how many times a command is retried when zopen
+	// reports its lock is held.
+	lockRetries = 5
+
+	// lockRetryBackoff is the pause before the first retry; it doubles
+	// with each further attempt.
+	lockRetryBackoff = 5 * time.Second
+)
+
+// lockHeld reports whether a failed command failed because zopen's lock was
+// held by another process.
+func lockHeld(res *CommandResult) bool {
+	return res != nil && res.ExitCode != 0 && lockHeldPattern.MatchString(res.Output())
+}
+
+// runMutating runs cmd on target once every earlier change to the target has
+// finished, retrying with backoff while zopen reports that its lock is held
+// by someone else. Queue position and retries are reported to progress,
+// which may be nil.
+func runMutating(ctx context.Context, target *Target, cmd Command, progress *ProgressReporter) (*CommandResult, error) {
+	release, err := acquireTarget(ctx, target, cmd, progress)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return runRetryingLock(ctx, target, cmd, progress)
+}
+
+// acquireTarget waits in target's queue until it is cmd's turn to change the
+// target, reporting the queue position to progress. The returned release
+// function must be called once the change is done.
+func acquireTarget(ctx context.Context, target *Target, cmd Command, progress *ProgressReporter) (release func(), err error) {
+	start := time.Now()
+	release, err = target.Queue.Acquire(ctx, cmd.String(), func(position int, running string) {
+		if os.Getenv("DEBUG") != "" {
+			log.Printf("Target %s: %s queued at position %d behind %s", target.Name, cmd, position, running)
+		}
+		progress.Status(fmt.Sprintf("Queued at position %d on target %s, waiting for '%s' to finish", position, target.Name, running))
+	})
+	if err != nil {
+		return nil, &QueuedError{
+			Command:  cmd.String(),
+			Host:     target.Address(),
+			Elapsed:  time.Since(start),
+			TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded),
+		}
+	}
+	return release, nil
+}
+
+// runRetryingLock runs cmd on target, retrying with backoff while zopen
+// reports that its lock is held by another process. The caller must hold
+// the target's queue.
+func runRetryingLock(ctx context.Context, target *Target, cmd Command, progress *ProgressReporter) (*CommandResult, error) {
+	start := time.Now()
+	delay := lockRetryBackoff
+	for attempt := 0; ; attempt++ {
+		res, err := target.Exec.Run(ctx, cmd)
+		if err != nil || !lockHeld(res) || attempt == lockRetries {
+			return res, err
+		}
+		log.Printf("Warning: target %s: zopen lock is held, retrying %s in %s", target.Name, cmd, delay)
+		progress.Status(fmt.Sprintf("zopen lock is held by another process, retrying in %s", delay))
+		select {
+		case <-ctx.Done():
+			return nil, cancelledError(ctx, cmd, target.Address(), time.Since(start), nil)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
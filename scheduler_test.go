@@ -0,0 +1,91 @@
+// scheduler_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// lockedTarget returns a target on which zopen always reports its lock held.
+func lockedTarget() (*Target, *FakeExecutor) {
+	fake := &FakeExecutor{Respond: func(cmd Command) (*CommandResult, error) {
+		return &CommandResult{Command: cmd.String(), Host: "fake", ExitCode: 1,
+			Stderr: "Could not obtain the lock: another zopen process is running\n"}, nil
+	}}
+	return &Target{Name: "dev", Remote: true, Host: "dev.example.com", Port: 22, Exec: fake, Queue: &TargetQueue{}}, fake
+}
+
+func TestRunRetryingLockTimesOut(t *testing.T) {
+	target, fake := lockedTarget()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	res, err := runMutating(ctx, target, Command{Program: "zopen", Args: []string{"install", "curl"}}, nil)
+	var cancelled *CancelledError
+	if !errors.As(err, &cancelled) || !cancelled.TimedOut {
+		t.Fatalf("runMutating = %v, %v; want a timeout", res, err)
+	}
+	if res != nil {
+		t.Errorf("got a result with the timeout: %+v", res)
+	}
+	if code := classifyError(res, err); code != CodeTimeout {
+		t.Errorf("error code = %s, want %s", code, CodeTimeout)
+	}
+	if n := len(fake.Calls()); n != 1 {
+		t.Errorf("command ran %d times, want 1", n)
+	}
+}
+
+func TestRunRetryingLockCancelled(t *testing.T) {
+	target, _ := lockedTarget()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := runMutating(ctx, target, Command{Program: "zopen", Args: []string{"remove", "curl"}}, nil)
+	var cancelled *CancelledError
+	if !errors.As(err, &cancelled) || cancelled.TimedOut {
+		t.Fatalf("runMutating = %v; want a cancellation", err)
+	}
+}
+
+func TestTargetQueueOrder(t *testing.T) {
+	q := &TargetQueue{}
+	release, err := q.Acquire(context.Background(), "first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 2)
+	positions := make(chan int, 2)
+	for _, desc := range []string{"second", "third"} {
+		go func() {
+			release, err := q.Acquire(context.Background(), desc, func(position int, running string) {
+				positions <- position
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- desc
+			release()
+		}()
+		// Let each call join the queue before the next.
+		if p := <-positions; p < 1 {
+			t.Errorf("%s queued at position %d", desc, p)
+		}
+	}
+
+	// A call that gives up leaves the queue.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.Acquire(ctx, "impatient", func(int, string) {}); err == nil {
+		t.Error("Acquire with a cancelled context succeeded")
+	}
+
+	release()
+	if first, second := <-order, <-order; first != "second" || second != "third" {
+		t.Errorf("calls ran in order %s, %s", first, second)
+	}
+}
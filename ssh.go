@@ -0,0 +1,509 @@
+// ssh.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// passphraseEnv names the environment variable holding the passphrase for an
+// encrypted private key. It is read from the environment rather than a flag so
+// the secret never shows up in the process list.
+const passphraseEnv = "ZOPEN_MCP_KEY_PASSPHRASE"
+
+// --- SSH Connection Pool ---
+
+// SSHPool keeps one persistent SSH connection per remote endpoint so that
+// repeated tool calls reuse the same handshake. Each command runs in its own
+// session on the shared connection.
+type SSHPool struct {
+	config *Config // host key settings shared by all targets
+
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+	dialing map[string]*pendingDial // connections being dialed, by pool key
+}
+
+// pendingDial is a connection being dialed. Calls that need it while it is
+// dialed wait for done instead of dialing again.
+type pendingDial struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+// NewSSHPool creates an empty connection pool.
+func NewSSHPool(config *Config) *SSHPool {
+	return &SSHPool{
+		config:  config,
+		clients: make(map[string]*ssh.Client),
+		dialing: make(map[string]*pendingDial),
+	}
+}
+
+// sshAddr returns the host:port address of a remote target.
+func sshAddr(target *Target) string {
+	return net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+}
+
+// poolKey identifies a connection in the pool. Targets only share a
+// connection if they reach the host the same way and pin the same host key,
+// so a connection made for one target never skips the checks of another.
+func poolKey(target *Target) string {
+	key := fmt.Sprintf("%s@%s", target.User, sshAddr(target))
+	if target.HostKeyFingerprint != "" {
+		key += " fingerprint=" + target.HostKeyFingerprint
+	}
+	if target.ProxyCommand != "" {
+		key += fmt.Sprintf(" proxy-command=%q", target.ProxyCommand)
+	}
+	for _, hop := range target.Jumps {
+		key += " via " + poolKey(hop)
+	}
+	return key
+}
+
+// client returns a live connection to target, dialing a new one if needed.
+// The pool is not locked while dialing, so an unreachable host only holds up
+// the calls that need it.
+func (p *SSHPool) client(ctx context.Context, target *Target) (*ssh.Client, error) {
+	key := poolKey(target)
+
+	p.mu.Lock()
+	if c, ok := p.clients[key]; ok {
+		p.mu.Unlock()
+		return c, nil
+	}
+	d, ok := p.dialing[key]
+	if !ok {
+		d = &pendingDial{done: make(chan struct{})}
+		p.dialing[key] = d
+		// Other calls may come to wait for the connection, so one of them
+		// giving up must not abort the dial; the connect timeout bounds it.
+		go p.dial(context.WithoutCancel(ctx), target, key, d)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return d.client, d.err
+	case <-ctx.Done():
+		return nil, connectionError(fmt.Errorf("gave up waiting for the connection to %s: %w", sshAddr(target), ctx.Err()))
+	}
+}
+
+// dial connects to target and completes d, adding the connection to the pool
+// if it succeeded.
+func (p *SSHPool) dial(ctx context.Context, target *Target, key string, d *pendingDial) {
+	c, err := dialSSH(ctx, p.config, target)
+
+	p.mu.Lock()
+	delete(p.dialing, key)
+	if err == nil {
+		p.clients[key] = c
+	}
+	p.mu.Unlock()
+	d.client, d.err = c, err
+	close(d.done)
+	if err != nil {
+		return
+	}
+
+	// Drop the connection from the pool once the server goes away so the
+	// next call redials instead of failing on a dead client.
+	c.Wait()
+	p.mu.Lock()
+	if p.clients[key] == c {
+		delete(p.clients, key)
+	}
+	p.mu.Unlock()
+}
+
+// discard closes and forgets the connection to target.
+func (p *SSHPool) discard(target *Target, c *ssh.Client) {
+	key := poolKey(target)
+	p.mu.Lock()
+	if p.clients[key] == c {
+		delete(p.clients, key)
+	}
+	p.mu.Unlock()
+	c.Close()
+}
+
+// Close shuts down every pooled connection.
+func (p *SSHPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, c := range p.clients {
+		c.Close()
+		delete(p.clients, key)
+	}
+}
+
+// NewSession opens a session on the pooled connection to target.
+func (p *SSHPool) NewSession(ctx context.Context, target *Target) (*ssh.Session, error) {
+	c, err := p.client(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := c.NewSession()
+	if err != nil {
+		// The pooled connection may have been closed by the server since
+		// it was last used. Redial once before giving up.
+		p.discard(target, c)
+		if c, err = p.client(ctx, target); err != nil {
+			return nil, err
+		}
+		if session, err = c.NewSession(); err != nil {
+			return nil, connectionError(fmt.Errorf("failed to open SSH session: %w", err))
+		}
+	}
+	return session, nil
+}
+
+// --- Remote Process Control ---
+
+// pidMarker prefixes the line on which a remote command reports its PID.
+const pidMarker = "__ZOPEN_MCP_PID="
+
+// remoteKillTimeout bounds how long we wait for the remote kill to run.
+const remoteKillTimeout = 15 * time.Second
+
+// withPIDReport wraps remoteCmd so that it first prints its PID to stderr.
+// The shell then execs the command, so the PID stays the same and every
+// process it starts inherits its process group.
+func withPIDReport(remoteCmd string) string {
+	return "/bin/sh -c " + shellQuote("echo "+pidMarker+"$$ >&2; exec "+remoteCmd)
+}
+
+// pidCapture strips the PID report from a remote stderr stream and records
+// the PID.
+type pidCapture struct {
+	w       io.Writer
+	pid     atomic.Int64
+	pending []byte
+	done    bool
+}
+
+func (c *pidCapture) Write(p []byte) (int, error) {
+	if c.done {
+		return c.w.Write(p)
+	}
+	c.pending = append(c.pending, p...)
+	i := bytes.IndexByte(c.pending, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	c.done = true
+
+	line, rest := c.pending[:i], c.pending[i+1:]
+	if pid, ok := bytes.CutPrefix(line, []byte(pidMarker)); ok {
+		if n, err := strconv.ParseInt(string(bytes.TrimSpace(pid)), 10, 64); err == nil {
+			c.pid.Store(n)
+		}
+	} else {
+		rest = c.pending
+	}
+	if _, err := c.w.Write(rest); err != nil {
+		return 0, err
+	}
+	c.pending = nil
+	return len(p), nil
+}
+
+// Flush writes anything still buffered, which only happens when the command
+// produced stderr output without a trailing newline before the PID report.
+func (c *pidCapture) Flush() {
+	if !c.done && len(c.pending) > 0 {
+		c.w.Write(c.pending)
+	}
+	c.done = true
+}
+
+// killRemote terminates the process group of the remote command with PID pid
+// using a separate session: SIGTERM first, then SIGKILL after a grace period.
+func (p *SSHPool) killRemote(target *Target, pid int64) error {
+	if pid <= 0 {
+		return fmt.Errorf("remote PID unknown")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteKillTimeout)
+	defer cancel()
+
+	session, err := p.NewSession(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	script := fmt.Sprintf(`pgid=$(ps -o pgid= -p %[1]d 2>/dev/null | tr -d ' ')
+if [ -n "$pgid" ]; then
+  kill -s TERM -- -$pgid 2>/dev/null || kill -s TERM %[1]d
+  (sleep 5; kill -s KILL -- -$pgid) >/dev/null 2>&1 </dev/null &
+else
+  kill -s TERM %[1]d 2>/dev/null
+fi
+exit 0`, pid)
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run("/bin/sh -c " + shellQuote(script)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out killing remote process %d", pid)
+	}
+}
+
+// --- Dialing and Authentication ---
+
+// dialSSH opens a new authenticated SSH connection to target, verifying its
+// host key according to config. The connection goes through the target's
+// jump hosts or proxy command, if any, and is kept alive with keepalive
+// requests.
+func dialSSH(ctx context.Context, config *Config, target *Target) (*ssh.Client, error) {
+	var jumps []*ssh.Client
+	closeJumps := func() {
+		for i := len(jumps) - 1; i >= 0; i-- {
+			jumps[i].Close()
+		}
+	}
+
+	// Each hop is reached through the previous one; the first is dialed
+	// directly.
+	var via *ssh.Client
+	for _, hop := range target.Jumps {
+		c, err := dialHop(ctx, config, hop, via)
+		if err != nil {
+			closeJumps()
+			return nil, fmt.Errorf("jump host %s: %w", sshAddr(hop), err)
+		}
+		jumps = append(jumps, c)
+		via = c
+	}
+
+	c, err := dialHop(ctx, config, target, via)
+	if err != nil {
+		closeJumps()
+		return nil, err
+	}
+	go func() {
+		c.Wait()
+		closeJumps()
+	}()
+	go keepAlive(c, target.KeepAlive)
+	return c, nil
+}
+
+// dialHop connects and authenticates to a single host, either directly,
+// through its proxy command, or through the already connected jump host via.
+func dialHop(ctx context.Context, config *Config, target *Target, via *ssh.Client) (*ssh.Client, error) {
+	user := target.User
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	auth, closeAgent, err := sshAuthMethods(target)
+	if err != nil {
+		return nil, authError(err)
+	}
+	// The agent is only needed for the handshake.
+	defer closeAgent()
+
+	addr := sshAddr(target)
+	hostKeys, algorithms, err := hostKeyCallback(config, target, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, target.ConnectTimeout)
+	defer cancel()
+
+	var conn net.Conn
+	switch {
+	case via != nil:
+		conn, err = via.DialContext(ctx, "tcp", addr)
+	case target.ProxyCommand != "":
+		conn, err = dialProxyCommand(target)
+	default:
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, connectionError(fmt.Errorf("failed to connect to %s: %w", addr, err))
+	}
+	clientConfig.HostKeyAlgorithms = algorithms(conn.RemoteAddr())
+
+	// Bound the handshake too: a host behind a proxy can accept the
+	// connection and then never answer.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if !stop() && err == nil {
+		sshConn.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		var hostKeyErr *HostKeyError
+		if errors.As(err, &hostKeyErr) {
+			return nil, hostKeyErr
+		}
+		if ctx.Err() != nil {
+			return nil, connectionError(fmt.Errorf("SSH handshake with %s timed out after %s", addr, target.ConnectTimeout))
+		}
+		err = fmt.Errorf("SSH handshake with %s failed: %w", addr, err)
+		// The library does not export a type for rejected credentials.
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, authError(err)
+		}
+		return nil, connectionError(err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// keepAlive sends keepalive requests on c every interval until it closes,
+// and closes it once keepAliveCountMax intervals pass without an answer, so
+// the pool redials instead of waiting on a dead connection.
+func keepAlive(c *ssh.Client, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err != nil {
+				c.Close()
+				return
+			}
+		case <-time.After(keepAliveCountMax * interval):
+			if os.Getenv("DEBUG") != "" {
+				log.Printf("SSH connection to %s stopped answering keepalives; closing it", c.RemoteAddr())
+			}
+			c.Close()
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// sshAuthMethods collects the authentication methods to offer: the running
+// ssh-agent first, then the configured key file, or the default identity
+// files when no key was given. The returned function closes the connection
+// to the agent and must be called once the handshake is done.
+func sshAuthMethods(target *Target) ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	closeAgent := func() {}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			closeAgent = func() { conn.Close() }
+		}
+	}
+
+	if target.Key != "" {
+		signer, err := loadSigner(expandHome(target.Key))
+		if err != nil {
+			closeAgent()
+			return nil, nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	} else {
+		var signers []ssh.Signer
+		for _, path := range defaultIdentityFiles() {
+			if signer, err := loadSigner(path); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+		if len(signers) > 0 {
+			methods = append(methods, ssh.PublicKeys(signers...))
+		}
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, fmt.Errorf("no SSH credentials available: pass --key or start an ssh-agent")
+	}
+	return methods, closeAgent, nil
+}
+
+// defaultIdentityFiles lists the private keys ssh would try by default.
+func defaultIdentityFiles() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		files = append(files, filepath.Join(home, ".ssh", name))
+	}
+	return files
+}
+
+// loadSigner reads a private key, decrypting it with the passphrase from
+// ZOPEN_MCP_KEY_PASSPHRASE if the key is protected.
+func loadSigner(path string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key %s: %w", path, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("failed to parse SSH key %s: %w", path, err)
+	}
+	passphrase := os.Getenv(passphraseEnv)
+	if passphrase == "" {
+		return nil, fmt.Errorf("SSH key %s is passphrase protected: set %s or use ssh-agent", path, passphraseEnv)
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt SSH key %s: %w", path, err)
+	}
+	return signer, nil
+}
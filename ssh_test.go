@@ -0,0 +1,574 @@
+// ssh_test.go
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// --- In-Process SSH Server ---
+
+// testSSHServer is an SSH server on localhost that runs exec requests with
+// the local /bin/sh and forwards direct-tcpip channels, so it can stand in
+// for a z/OS host or a jump host.
+type testSSHServer struct {
+	t        *testing.T
+	listener net.Listener
+	hostKey  ssh.Signer
+	config   *ssh.ServerConfig
+
+	connections atomic.Int32 // connections that completed the handshake
+	forwards    atomic.Int32 // direct-tcpip channels opened through the server
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+}
+
+// newTestSigner returns a new ed25519 key and the path of its private key
+// file in OpenSSH format.
+func newTestSigner(t *testing.T) (ssh.Signer, string) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return signer, path
+}
+
+// startTestSSHServer starts a server that accepts the user "tester" with the
+// authorized key. It offers a new ed25519 host key and any extra host keys
+// given. It stops when the test ends.
+func startTestSSHServer(t *testing.T, authorized ssh.PublicKey, extraHostKeys ...ssh.Signer) *testSSHServer {
+	t.Helper()
+	hostKey, _ := newTestSigner(t)
+	s := &testSSHServer{t: t, hostKey: hostKey}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == "tester" && string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unauthorized key for %s", meta.User())
+		},
+	}
+	s.config.AddHostKey(hostKey)
+	for _, k := range extraHostKeys {
+		s.config.AddHostKey(k)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = l
+	t.Cleanup(func() {
+		l.Close()
+		s.dropAll()
+	})
+	go s.serve()
+	return s
+}
+
+// target returns a remote target for the server, authenticating with the
+// key in keyFile and pinning the server's host key.
+func (s *testSSHServer) target(keyFile string) *Target {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return &Target{
+		Name:               host,
+		Remote:             true,
+		Host:               host,
+		Port:               p,
+		User:               "tester",
+		Key:                keyFile,
+		HostKeyFingerprint: ssh.FingerprintSHA256(s.hostKey.PublicKey()),
+		ConnectTimeout:     5 * time.Second,
+		Bootstrap:          bootstrapNone,
+		Codepage:           "UTF-8",
+	}
+}
+
+// dropAll closes every connection to the server, as a host going away would.
+func (s *testSSHServer) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *testSSHServer) handleConn(conn net.Conn) {
+	sc, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.connections.Add(1)
+	s.mu.Lock()
+	s.conns = append(s.conns, sc)
+	s.mu.Unlock()
+
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			go s.handleSession(nc)
+		case "direct-tcpip":
+			go s.handleForward(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// handleSession runs the command of an exec request with /bin/sh.
+func (s *testSSHServer) handleSession(nc ssh.NewChannel) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(reqs)
+
+		cmd := exec.Command("/bin/sh", "-c", payload.Command)
+		cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+		status := 0
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				s.t.Logf("test server: %v", err)
+			}
+			status = 255
+			if exitErr != nil && exitErr.ExitCode() >= 0 {
+				status = exitErr.ExitCode()
+			}
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		return
+	}
+}
+
+// handleForward connects a direct-tcpip channel to the address it asks for.
+func (s *testSSHServer) handleForward(nc ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		nc.Reject(ssh.ConnectionFailed, "bad payload")
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.forwards.Add(1)
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+	ch.Close()
+}
+
+// noAgent keeps the tests from offering keys of the developer's ssh-agent.
+func noAgent(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+}
+
+// --- Tests ---
+
+func TestSSHExecutorRunsCommand(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+
+	executor := NewSSHExecutor(srv.target(keyFile), pool)
+	arg := `it's "$HOME"; $(echo injected)`
+	res, err := executor.Run(context.Background(), Command{Program: "printf", Args: []string{"%s|%s", arg, "second"}})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if want := arg + "|second"; res.Stdout != want {
+		t.Errorf("stdout = %q, want %q", res.Stdout, want)
+	}
+	if res.ExitCode != 0 {
+		t.Errorf("exit code = %d, want 0", res.ExitCode)
+	}
+
+	res, err = executor.Run(context.Background(), Command{Program: "/bin/sh", Args: []string{"-c", "echo oops >&2; exit 3"}})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.ExitCode != 3 || res.Stderr != "oops\n" {
+		t.Errorf("got exit code %d, stderr %q; want 3, %q", res.ExitCode, res.Stderr, "oops\n")
+	}
+}
+
+func TestSSHPoolRejectsUnauthorizedKey(t *testing.T) {
+	noAgent(t)
+	authorized, _ := newTestSigner(t)
+	_, otherKey := newTestSigner(t)
+	srv := startTestSSHServer(t, authorized.PublicKey())
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+
+	_, err := pool.NewSession(context.Background(), srv.target(otherKey))
+	if code := classifyError(nil, err); code != CodeAuth {
+		t.Fatalf("error code = %q (%v), want %q", code, err, CodeAuth)
+	}
+}
+
+func TestSSHPoolRejectsWrongHostKey(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+
+	target := srv.target(keyFile)
+	other, _ := newTestSigner(t)
+	target.HostKeyFingerprint = ssh.FingerprintSHA256(other.PublicKey())
+	_, err := pool.NewSession(context.Background(), target)
+	if code := classifyError(nil, err); code != CodeHostKey {
+		t.Fatalf("error code = %q (%v), want %q", code, err, CodeHostKey)
+	}
+}
+
+func TestSSHPoolChecksEachTargetsHostKey(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	jump := startTestSSHServer(t, signer.PublicKey())
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+
+	// A connection made for a target with the right pin must not be reused
+	// for a target pinning another key.
+	if _, err := NewSSHExecutor(srv.target(keyFile), pool).Run(context.Background(), Command{Program: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	pinned := srv.target(keyFile)
+	other, _ := newTestSigner(t)
+	pinned.HostKeyFingerprint = ssh.FingerprintSHA256(other.PublicKey())
+	_, err := pool.NewSession(context.Background(), pinned)
+	if code := classifyError(nil, err); code != CodeHostKey {
+		t.Errorf("error code = %q (%v), want %q", code, err, CodeHostKey)
+	}
+
+	// Nor for one that reaches the host through a jump host.
+	via := srv.target(keyFile)
+	via.Jumps = []*Target{jump.target(keyFile)}
+	if _, err := NewSSHExecutor(via, pool).Run(context.Background(), Command{Program: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := jump.forwards.Load(); n != 1 {
+		t.Errorf("jump host forwarded %d connections, want 1", n)
+	}
+}
+
+// writeKnownHosts writes a known_hosts file with one line per host pattern,
+// all holding key.
+func writeKnownHosts(t *testing.T, key ssh.PublicKey, hosts ...string) string {
+	t.Helper()
+	var lines string
+	for _, h := range hosts {
+		lines += knownhosts.Line([]string{h}, key) + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newECDSASigner returns a new ECDSA key, a host key type the client prefers
+// over ed25519 unless it is told otherwise.
+func newECDSASigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestSSHPoolAcceptsKnownHost(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	// The server also offers a key type we hold nothing for: the handshake
+	// must settle on the one on record instead of reporting a changed key.
+	srv := startTestSSHServer(t, signer.PublicKey(), newECDSASigner(t))
+	target := srv.target(keyFile)
+	target.HostKeyFingerprint = ""
+	entry := knownhosts.Normalize(sshAddr(target))
+
+	tests := []struct {
+		name  string
+		entry string // host pattern on record in known_hosts
+	}{
+		{"plain", entry},
+		{"hashed", knownhosts.HashHostname(entry)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewSSHPool(&Config{KnownHostsFile: writeKnownHosts(t, srv.hostKey.PublicKey(), tt.entry)})
+			defer pool.Close()
+			if _, err := NewSSHExecutor(target, pool).Run(context.Background(), Command{Program: "true"}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSSHPoolRejectsChangedHostKey(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	other, _ := newTestSigner(t)
+	target := srv.target(keyFile)
+	target.HostKeyFingerprint = ""
+
+	// Trust-on-first-use must not replace a key that is on record.
+	pool := NewSSHPool(&Config{
+		KnownHostsFile:    writeKnownHosts(t, other.PublicKey(), knownhosts.Normalize(sshAddr(target))),
+		TrustStore:        filepath.Join(t.TempDir(), "trust"),
+		AcceptNewHostKeys: true,
+	})
+	defer pool.Close()
+
+	_, err := pool.NewSession(context.Background(), target)
+	var hostKeyErr *HostKeyError
+	if !errors.As(err, &hostKeyErr) || hostKeyErr.Reason != "changed" {
+		t.Fatalf("error = %v, want a changed host key", err)
+	}
+	if code := classifyError(nil, err); code != CodeHostKey {
+		t.Errorf("error code = %q, want %q", code, CodeHostKey)
+	}
+}
+
+func TestSSHPoolPinsNewHostKey(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	target := srv.target(keyFile)
+	target.HostKeyFingerprint = ""
+	store := filepath.Join(t.TempDir(), "zopen-mcp-server", "known_hosts")
+
+	// Unknown hosts are rejected unless trust-on-first-use is enabled.
+	pool := NewSSHPool(&Config{TrustStore: store})
+	_, err := pool.NewSession(context.Background(), target)
+	pool.Close()
+	var hostKeyErr *HostKeyError
+	if !errors.As(err, &hostKeyErr) || hostKeyErr.Reason != "unknown" {
+		t.Fatalf("error = %v, want an unknown host key", err)
+	}
+
+	pool = NewSSHPool(&Config{TrustStore: store, AcceptNewHostKeys: true})
+	_, err = NewSSHExecutor(target, pool).Run(context.Background(), Command{Program: "true"})
+	pool.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pinned key is trusted from then on.
+	pool = NewSSHPool(&Config{TrustStore: store})
+	defer pool.Close()
+	if _, err := NewSSHExecutor(target, pool).Run(context.Background(), Command{Program: "true"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolKey(t *testing.T) {
+	base := &Target{User: "ibmuser", Host: "zos.example.com", Port: 22}
+	variants := []*Target{
+		{User: "ibmuser", Host: "zos.example.com", Port: 22, HostKeyFingerprint: "SHA256:abc"},
+		{User: "ibmuser", Host: "zos.example.com", Port: 22, ProxyCommand: "nc %h %p"},
+		{User: "ibmuser", Host: "zos.example.com", Port: 22, Jumps: []*Target{{User: "j", Host: "bastion", Port: 22}}},
+		{User: "ibmuser", Host: "zos.example.com", Port: 22, Jumps: []*Target{{User: "j", Host: "bastion", Port: 22, HostKeyFingerprint: "SHA256:abc"}}},
+		{User: "other", Host: "zos.example.com", Port: 22},
+		{User: "ibmuser", Host: "zos.example.com", Port: 2222},
+	}
+	seen := map[string]bool{poolKey(base): true}
+	for _, v := range variants {
+		key := poolKey(v)
+		if seen[key] {
+			t.Errorf("poolKey %q is shared with another way of reaching the host", key)
+		}
+		seen[key] = true
+	}
+	same := *base
+	same.Name, same.Key = "alias", "~/.ssh/id"
+	if poolKey(&same) != poolKey(base) {
+		t.Error("targets reaching the host the same way do not share a connection")
+	}
+}
+
+func TestSSHPoolReusesConnection(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+	target := srv.target(keyFile)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, err := pool.NewSession(context.Background(), target)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			session.Close()
+		}()
+	}
+	wg.Wait()
+	if n := srv.connections.Load(); n != 1 {
+		t.Errorf("server saw %d connections, want 1", n)
+	}
+}
+
+func TestSSHPoolRedialsAfterDrop(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+	executor := NewSSHExecutor(srv.target(keyFile), pool)
+
+	if _, err := executor.Run(context.Background(), Command{Program: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.dropAll()
+	res, err := executor.Run(context.Background(), Command{Program: "echo", Args: []string{"again"}})
+	if err != nil {
+		t.Fatalf("Run after the connection dropped: %v", err)
+	}
+	if res.Stdout != "again\n" {
+		t.Errorf("stdout = %q, want %q", res.Stdout, "again\n")
+	}
+	if n := srv.connections.Load(); n != 2 {
+		t.Errorf("server saw %d connections, want 2", n)
+	}
+}
+
+func TestSSHPoolDialsWithoutBlockingOtherTargets(t *testing.T) {
+	noAgent(t)
+	signer, keyFile := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	pool := NewSSHPool(&Config{})
+	defer pool.Close()
+
+	// A host that accepts connections and never answers the handshake.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	stuck := srv.target(keyFile)
+	stuck.Port = silent.Addr().(*net.TCPAddr).Port
+	stuck.ConnectTimeout = 10 * time.Second
+
+	stuckDone := make(chan error, 1)
+	go func() {
+		_, err := pool.NewSession(context.Background(), stuck)
+		stuckDone <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	session, err := pool.NewSession(context.Background(), srv.target(keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dialing a reachable host took %s while another host was hanging", elapsed)
+	}
+
+	select {
+	case err := <-stuckDone:
+		t.Fatalf("dial to the silent host returned early: %v", err)
+	default:
+	}
+}
@@ -0,0 +1,173 @@
+// sshconfig.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// --- SSH Client Configuration ---
+
+const (
+	// defaultSSHPort is used when neither the target, ssh_config nor --port
+	// give a port.
+	defaultSSHPort = 22
+
+	// defaultConnectTimeout bounds connecting to and handshaking with each
+	// host on the way to a target when no connect timeout is configured.
+	defaultConnectTimeout = 30 * time.Second
+
+	// defaultKeepAlive is the keepalive interval used when none is
+	// configured. Pooled connections are long lived, and firewalls between
+	// us and the host drop idle ones.
+	defaultKeepAlive = time.Minute
+
+	// keepAliveCountMax is how many keepalive intervals may pass without
+	// an answer before the connection is considered dead.
+	keepAliveCountMax = 3
+)
+
+// defaultSSHConfigFile returns the user's ~/.ssh/config path.
+func defaultSSHConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// sshConfig gives access to the Host sections of an OpenSSH client config
+// file. A nil *sshConfig has no settings.
+type sshConfig struct {
+	path string
+	cfg  *ssh_config.Config
+}
+
+// loadSSHConfig parses the ssh_config file at path. A missing file is not an
+// error, since most users never create one.
+func loadSSHConfig(path string) (*sshConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(expandHome(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ssh config: %w", err)
+	}
+	defer f.Close()
+	cfg, err := ssh_config.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &sshConfig{path: path, cfg: cfg}, nil
+}
+
+// get returns the value of key for host alias, or "" if it is not set.
+func (c *sshConfig) get(alias, key string) (value string) {
+	if c == nil {
+		return ""
+	}
+	defer func() {
+		// The parser gives up on Match blocks by panicking; treat the
+		// setting as absent rather than failing the connection.
+		if r := recover(); r != nil {
+			log.Printf("Warning: %s: ignoring %s for %s: %v", c.path, key, alias, r)
+			value = ""
+		}
+	}()
+	value, _ = c.cfg.Get(alias, key)
+	return value
+}
+
+// seconds parses an ssh_config value given in seconds.
+func (c *sshConfig) seconds(alias, key string) (time.Duration, error) {
+	value := c.get(alias, key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid %s %q for %s", c.path, key, value, alias)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// apply fills in settings of target that are not set yet from the Host
+// section matching its host name, treating the host as an alias the way ssh
+// does.
+func (c *sshConfig) apply(target *Target) error {
+	if c == nil {
+		return nil
+	}
+	alias := target.Host
+	if target.User == "" {
+		target.User = c.get(alias, "User")
+	}
+	if target.Key == "" {
+		target.Key = c.get(alias, "IdentityFile")
+	}
+	if target.Port == 0 {
+		if port := c.get(alias, "Port"); port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return fmt.Errorf("%s: invalid Port %q for %s", c.path, port, alias)
+			}
+			target.Port = p
+		}
+	}
+	if target.ProxyJump == "" && target.ProxyCommand == "" {
+		target.ProxyJump = c.get(alias, "ProxyJump")
+		if target.ProxyJump == "" {
+			target.ProxyCommand = c.get(alias, "ProxyCommand")
+		}
+	}
+	if target.ProxyJump == "none" {
+		target.ProxyJump = ""
+	}
+	if target.ProxyCommand == "none" {
+		target.ProxyCommand = ""
+	}
+	if target.ConnectTimeout == 0 {
+		d, err := c.seconds(alias, "ConnectTimeout")
+		if err != nil {
+			return err
+		}
+		target.ConnectTimeout = d
+	}
+	if target.KeepAlive == 0 {
+		d, err := c.seconds(alias, "ServerAliveInterval")
+		if err != nil {
+			return err
+		}
+		target.KeepAlive = d
+	}
+	// HostName last: everything above is looked up by the alias.
+	if hostname := c.get(alias, "HostName"); hostname != "" {
+		target.Host = strings.ReplaceAll(hostname, "%h", alias)
+	}
+	return nil
+}
+
+// expandHome expands a leading "~/" in a local path to the user's home
+// directory, as ssh does for paths in its config.
+func expandHome(path string) string {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, rest)
+}
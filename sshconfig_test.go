@@ -0,0 +1,118 @@
+// sshconfig_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeSSHConfig writes text as an ssh_config file and loads it.
+func writeSSHConfig(t *testing.T, text string) *sshConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestSSHConfigApply(t *testing.T) {
+	config := writeSSHConfig(t, `
+Host dev
+    HostName dev.zos.example.com
+    User ibmuser
+    Port 2222
+    IdentityFile ~/.ssh/dev
+    ProxyJump bastion
+    ConnectTimeout 15
+    ServerAliveInterval 30
+
+Host test
+    HostName %h.zos.example.com
+    ProxyCommand nc %h %p
+
+Host direct
+    ProxyJump none
+
+Host badport
+    Port twenty-two
+
+Host badtimeout
+    ConnectTimeout soon
+
+Host *
+    User fallback
+`)
+	tests := []struct {
+		name    string
+		target  Target
+		want    Target
+		wantErr bool
+	}{
+		{
+			name:   "alias fills unset settings",
+			target: Target{Host: "dev"},
+			want: Target{Host: "dev.zos.example.com", User: "ibmuser", Port: 2222, Key: "~/.ssh/dev",
+				ProxyJump: "bastion", ConnectTimeout: 15 * time.Second, KeepAlive: 30 * time.Second},
+		},
+		{
+			name:   "explicit settings win",
+			target: Target{Host: "dev", User: "me", Port: 22, Key: "/keys/me", ProxyCommand: "connect %h %p", ConnectTimeout: time.Second, KeepAlive: time.Minute},
+			want: Target{Host: "dev.zos.example.com", User: "me", Port: 22, Key: "/keys/me",
+				ProxyCommand: "connect %h %p", ConnectTimeout: time.Second, KeepAlive: time.Minute},
+		},
+		{
+			name:   "hostname token and proxy command",
+			target: Target{Host: "test"},
+			want:   Target{Host: "test.zos.example.com", User: "fallback", ProxyCommand: "nc %h %p"},
+		},
+		{
+			name:   "none disables the jump host",
+			target: Target{Host: "direct"},
+			want:   Target{Host: "direct", User: "fallback"},
+		},
+		{
+			name:   "unknown host gets wildcard settings",
+			target: Target{Host: "zos.example.com"},
+			want:   Target{Host: "zos.example.com", User: "fallback"},
+		},
+		{name: "invalid port", target: Target{Host: "badport"}, wantErr: true},
+		{name: "invalid timeout", target: Target{Host: "badtimeout"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := tt.target
+			err := config.apply(&target)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("apply accepted %+v", target)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(target, tt.want) {
+				t.Errorf("apply gave\n%+v\nwant\n%+v", target, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHConfigNil(t *testing.T) {
+	var config *sshConfig
+	target := Target{Host: "dev"}
+	if err := config.apply(&target); err != nil || !reflect.DeepEqual(target, Target{Host: "dev"}) {
+		t.Errorf("nil config changed the target to %+v (%v)", target, err)
+	}
+	if config, err := loadSSHConfig(filepath.Join(t.TempDir(), "missing")); config != nil || err != nil {
+		t.Errorf("loadSSHConfig of a missing file = %v, %v", config, err)
+	}
+}
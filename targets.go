@@ -0,0 +1,393 @@
+// targets.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// --- Targets ---
+
+// localTarget is the name of the target that runs commands on the machine
+// hosting the server. It is always defined unless a --target replaces it.
+const localTarget = "local"
+
+// Target is a system tools can run commands on: the local machine or a z/OS
+// host reached over SSH.
+type Target struct {
+	Name   string
+	Remote bool
+
+	// SSH connection, for remote targets
+	Host string
+	User string
+	Key  string
+	Port int
+
+	// HostKeyFingerprint pins the host key instead of using known_hosts.
+	HostKeyFingerprint string
+
+	// ProxyJump lists the jump hosts to connect through, comma-separated
+	// and in order, as in ssh -J. ProxyCommand is a local command whose
+	// stdin and stdout are used as the connection instead. At most one of
+	// them is set.
+	ProxyJump    string
+	ProxyCommand string
+
+	// Jumps are the resolved hosts of ProxyJump.
+	Jumps []*Target
+
+	// ConnectTimeout bounds connecting to each host on the way to the
+	// target; KeepAlive is the interval between keepalive requests.
+	ConnectTimeout time.Duration
+	KeepAlive      time.Duration
+
+	// Codepage is the encoding of the host's output: "auto" to detect it,
+	// or a fixed codepage such as "IBM-1047".
+	Codepage string
+
+	// Bootstrap sets up the environment before each command: "auto",
+	// "none", "profile[:path]" or "zopen-config[:path]".
+	Bootstrap string
+
+	ZopenPath         string
+	ZopenGeneratePath string
+
+	// Exec runs commands on the target. It is set up at startup.
+	Exec Executor
+
+	// Queue serializes changes to the target. It is set up at startup and
+	// shared by targets on the same host.
+	Queue *TargetQueue
+}
+
+// ZopenBinary returns the zopen executable to run, honoring --zopen-path.
+func (t *Target) ZopenBinary() string {
+	if t.ZopenPath != "" {
+		return t.ZopenPath
+	}
+	return "zopen"
+}
+
+// ZopenGenerateBinary returns the zopen-generate executable to run, honoring
+// --zopen-generate-path.
+func (t *Target) ZopenGenerateBinary() string {
+	if t.ZopenGeneratePath != "" {
+		return t.ZopenGeneratePath
+	}
+	return "zopen-generate"
+}
+
+// Address describes where the target runs commands, e.g. "ibmuser@dev:22".
+func (t *Target) Address() string {
+	if !t.Remote {
+		return localHost
+	}
+	addr := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+	if t.User != "" {
+		addr = t.User + "@" + addr
+	}
+	return addr
+}
+
+// Target returns the target called name, or the default target if name is
+// empty.
+func (c *Config) Target(name string) (*Target, error) {
+	if name == "" {
+		name = c.DefaultTarget
+	}
+	target, ok := c.Targets[name]
+	if !ok {
+		return nil, validationError("unknown target %q (available: %s)", name, strings.Join(c.TargetNames(), ", "))
+	}
+	return target, nil
+}
+
+// TargetNames returns the names of all targets, sorted.
+func (c *Config) TargetNames() []string {
+	names := make([]string, 0, len(c.Targets))
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TargetParams is the argument struct for tools whose only arguments are the
+// optional environment, target and timeout.
+type TargetParams struct {
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+// targetFlag parses repeated --target name=spec flags into targets.
+type targetFlag map[string]*Target
+
+func (f targetFlag) String() string {
+	var parts []string
+	for name, t := range f {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, t.Address()))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+func (f targetFlag) Set(value string) error {
+	name, spec, ok := strings.Cut(value, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=spec, got %q", value)
+	}
+	target, err := parseTarget(name, spec)
+	if err != nil {
+		return err
+	}
+	f[name] = target
+	return nil
+}
+
+// parseTarget parses a target spec: "local", or "[user@]host[:port]",
+// followed by optional comma-separated settings, for example
+//
+//	ibmuser@dev.example.com:2222,key=~/.ssh/dev,bootstrap=zopen-config
+//
+// A field without "=" continues the previous setting, so jump host chains
+// can be written as proxy-jump=bastion1,bastion2. Settings left out are
+// filled in from ssh_config and the corresponding flags later.
+func parseTarget(name, spec string) (*Target, error) {
+	fields := strings.Split(spec, ",")
+	target := &Target{Name: name}
+
+	if addr := strings.TrimSpace(fields[0]); addr != localTarget {
+		target.Remote = true
+		if user, host, ok := strings.Cut(addr, "@"); ok {
+			target.User, addr = user, host
+		}
+		target.Host = addr
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: invalid port %q", name, port)
+			}
+			target.Host, target.Port = host, p
+		}
+		if target.Host == "" {
+			return nil, fmt.Errorf("target %s: host is required", name)
+		}
+	}
+
+	var settings [][2]string
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			if len(settings) == 0 {
+				return nil, fmt.Errorf("target %s: expected key=value, got %q", name, field)
+			}
+			settings[len(settings)-1][1] += "," + field
+			continue
+		}
+		settings = append(settings, [2]string{key, value})
+	}
+
+	for _, setting := range settings {
+		key, value := setting[0], setting[1]
+		switch key {
+		case "key":
+			target.Key = value
+		case "codepage":
+			target.Codepage = value
+		case "bootstrap":
+			target.Bootstrap = value
+		case "host-key-fingerprint":
+			target.HostKeyFingerprint = value
+		case "proxy-jump":
+			target.ProxyJump = value
+		case "proxy-command":
+			target.ProxyCommand = value
+		case "connect-timeout", "keepalive":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: invalid %s: %v", name, key, err)
+			}
+			if key == "keepalive" {
+				target.KeepAlive = d
+			} else {
+				target.ConnectTimeout = d
+			}
+		case "zopen-path":
+			target.ZopenPath = value
+		case "zopen-generate-path":
+			target.ZopenGeneratePath = value
+		default:
+			return nil, fmt.Errorf("target %s: unknown setting %q", name, key)
+		}
+		if !target.Remote && key != "zopen-path" && key != "zopen-generate-path" {
+			return nil, fmt.Errorf("target %s: %s only applies to remote targets", name, key)
+		}
+	}
+	return target, nil
+}
+
+// finishTarget fills in unset settings of a remote target from the matching
+// ssh_config Host section, then from defaults, and checks the result.
+func finishTarget(target, defaults *Target, sshConfig *sshConfig) error {
+	if !target.Remote {
+		return nil
+	}
+	if target.ZopenPath == "" {
+		target.ZopenPath = defaults.ZopenPath
+	}
+	if target.ZopenGeneratePath == "" {
+		target.ZopenGeneratePath = defaults.ZopenGeneratePath
+	}
+	if err := sshConfig.apply(target); err != nil {
+		return err
+	}
+	if target.User == "" {
+		target.User = defaults.User
+	}
+	if target.Key == "" {
+		target.Key = defaults.Key
+	}
+	if target.Port == 0 {
+		target.Port = defaults.Port
+	}
+	if target.Port == 0 {
+		target.Port = defaultSSHPort
+	}
+	if target.ProxyJump == "" && target.ProxyCommand == "" {
+		target.ProxyJump, target.ProxyCommand = defaults.ProxyJump, defaults.ProxyCommand
+	}
+	if target.ProxyJump != "" && target.ProxyCommand != "" {
+		return fmt.Errorf("target %s: proxy-jump and proxy-command cannot be used together", target.Name)
+	}
+	if target.ConnectTimeout == 0 {
+		target.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if target.ConnectTimeout == 0 {
+		target.ConnectTimeout = defaultConnectTimeout
+	}
+	if target.KeepAlive == 0 {
+		target.KeepAlive = defaults.KeepAlive
+	}
+	if target.KeepAlive == 0 {
+		target.KeepAlive = defaultKeepAlive
+	}
+	jumps, err := resolveJumps(target, sshConfig)
+	if err != nil {
+		return err
+	}
+	target.Jumps = jumps
+	if target.Codepage == "" {
+		target.Codepage = defaults.Codepage
+	}
+	if target.Bootstrap == "" {
+		target.Bootstrap = defaults.Bootstrap
+	}
+
+	codepage, err := normalizeCodepage(target.Codepage)
+	if err != nil {
+		return fmt.Errorf("target %s: %v", target.Name, err)
+	}
+	target.Codepage = codepage
+	bootstrap, err := normalizeBootstrap(target.Bootstrap)
+	if err != nil {
+		return fmt.Errorf("target %s: %v", target.Name, err)
+	}
+	target.Bootstrap = bootstrap
+	if target.HostKeyFingerprint != "" && !strings.HasPrefix(target.HostKeyFingerprint, "SHA256:") {
+		target.HostKeyFingerprint = "SHA256:" + target.HostKeyFingerprint
+	}
+	return nil
+}
+
+// setupTargets completes config.Targets: it adds the local target and, in
+// remote mode, the target described by the --remote flags, fills in settings
+// from defaults and picks the default target.
+func setupTargets(config *Config, defaults *Target, remote bool) error {
+	sshConfig, err := loadSSHConfig(config.SSHConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := config.Targets[localTarget]; !ok {
+		config.Targets[localTarget] = &Target{Name: localTarget}
+	}
+	if !remote {
+		// With --remote, --zopen-path and --zopen-generate-path name
+		// programs on the remote host, not this one.
+		local := config.Targets[localTarget]
+		if local.ZopenPath == "" {
+			local.ZopenPath = defaults.ZopenPath
+		}
+		if local.ZopenGeneratePath == "" {
+			local.ZopenGeneratePath = defaults.ZopenGeneratePath
+		}
+	}
+	if remote {
+		target := *defaults
+		target.Name = defaults.Host
+		target.Remote = true
+		if _, ok := config.Targets[target.Name]; ok {
+			return fmt.Errorf("--target %s conflicts with the --remote target of the same name", target.Name)
+		}
+		config.Targets[target.Name] = &target
+	}
+	for _, target := range config.Targets {
+		if err := finishTarget(target, defaults, sshConfig); err != nil {
+			return err
+		}
+	}
+
+	if config.DefaultTarget == "" {
+		config.DefaultTarget = localTarget
+		if remote {
+			config.DefaultTarget = defaults.Host
+		}
+	}
+	if _, ok := config.Targets[config.DefaultTarget]; !ok {
+		return fmt.Errorf("--default-target %q is not a defined target (available: %s)",
+			config.DefaultTarget, strings.Join(config.TargetNames(), ", "))
+	}
+	return nil
+}
+
+// --- ZopenListTargets Tool ---
+type ZopenListTargetsParams struct{}
+
+func (t *ZopenTools) ZopenListTargets(ctx context.Context, req *mcp.CallToolRequest, args ZopenListTargetsParams) (*mcp.CallToolResult, any, error) {
+	var b strings.Builder
+	for _, name := range t.Config.TargetNames() {
+		target := t.Config.Targets[name]
+		kind := "local"
+		if target.Remote {
+			kind = "remote"
+		}
+		fmt.Fprintf(&b, "%s: %s %s", name, kind, target.Address())
+		if target.Remote {
+			fmt.Fprintf(&b, ", codepage %s, bootstrap %s", target.Codepage, target.Bootstrap)
+			switch {
+			case target.ProxyJump != "":
+				fmt.Fprintf(&b, ", via %s", target.ProxyJump)
+			case target.ProxyCommand != "":
+				fmt.Fprintf(&b, ", via proxy command")
+			}
+		}
+		if name == t.Config.DefaultTarget {
+			b.WriteString(" (default)")
+		}
+		b.WriteString("\n")
+	}
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: b.String()}},
+		IsError: false,
+	}, nil, nil
+}
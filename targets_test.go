@@ -0,0 +1,45 @@
+// targets_test.go
+package main
+
+import "testing"
+
+func TestSetupTargetsZopenPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		remote      bool
+		targets     []string // --target flags
+		wantLocal   string
+		wantRemotes string
+	}{
+		{name: "local mode", wantLocal: "/opt/zopen/bin/zopen"},
+		{name: "remote mode", remote: true, wantLocal: "", wantRemotes: "/opt/zopen/bin/zopen"},
+		{name: "local mode with remote targets", targets: []string{"dev=dev.example.com"},
+			wantLocal: "/opt/zopen/bin/zopen", wantRemotes: "/opt/zopen/bin/zopen"},
+		{name: "explicit local target in remote mode", remote: true, targets: []string{"local=local,zopen-path=/usr/bin/zopen"},
+			wantLocal: "/usr/bin/zopen", wantRemotes: "/opt/zopen/bin/zopen"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := targetFlag{}
+			for _, spec := range tt.targets {
+				if err := flags.Set(spec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config := &Config{Targets: flags}
+			defaults := &Target{Host: "zos.example.com", User: "ibmuser", ZopenPath: "/opt/zopen/bin/zopen"}
+			if err := setupTargets(config, defaults, tt.remote); err != nil {
+				t.Fatal(err)
+			}
+			for name, target := range config.Targets {
+				want := tt.wantRemotes
+				if !target.Remote {
+					want = tt.wantLocal
+				}
+				if target.ZopenPath != want {
+					t.Errorf("target %s: ZopenPath = %q, want %q", name, target.ZopenPath, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+#!/bin/sh
+# capture.sh: captures the zopen output the parser tests read.
+#
+# Run it on a z/OS host with zopen on PATH, curl installed and jq not
+# installed, from the testdata directory. It overwrites the files with what
+# zopen prints on stdout and prints a row for each to paste into the table in
+# README.md.
+set -u
+
+host=$(uname -n)
+version=$(zopen --version 2>/dev/null | head -n 1)
+today=$(date +%Y-%m-%d)
+
+capture() {
+  file=$1
+  shift
+  "$@" >"$file"
+  echo "| $file | \`$*\` | $host, $version, $today |"
+}
+
+capture zopen-list.txt zopen list
+capture zopen-list-verbose.txt zopen list --verbose
+capture zopen-query.txt zopen query bash curl jq
+capture zopen-info-curl.txt zopen info curl
+capture zopen-info-jq.txt zopen info jq
@@ -0,0 +1,280 @@
+// testresults.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// --- Test Results ---
+
+// TestResults summarizes the check phase of a zopen build, as reported by
+// the port's zopen_check_results function.
+type TestResults struct {
+	Total            int    `json:"total" jsonschema:"number of tests run"`
+	ActualFailures   int    `json:"actual_failures" jsonschema:"number of tests that failed"`
+	ExpectedFailures int    `json:"expected_failures" jsonschema:"number of failures the port expects"`
+	ExpectedTotal    int    `json:"expected_total,omitempty" jsonschema:"number of tests the port expects to run, if it says"`
+	Verdict          string `json:"verdict" jsonschema:"pass if no more tests failed than expected, fail otherwise"`
+}
+
+// checkResultLine matches the key:value lines zopen_check_results prints.
+var checkResultLine = regexp.MustCompile(`^\s*(actualFailures|totalTests|expectedFailures|expectedTotalTests)\s*[:=]\s*(-?\d+)\s*$`)
+
+// parseTestResults returns the test results reported in a build log, or nil
+// if the build did not report any. The last report wins.
+func parseTestResults(log string) *TestResults {
+	var r TestResults
+	found := false
+	for _, line := range strings.Split(stripANSI(log), "\n") {
+		m := checkResultLine.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		switch m[1] {
+		case "totalTests":
+			r.Total = n
+		case "actualFailures":
+			r.ActualFailures = n
+		case "expectedFailures":
+			r.ExpectedFailures = n
+		case "expectedTotalTests":
+			r.ExpectedTotal = n
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	// zopen build fails the check phase on more failures than expected.
+	r.Verdict = "pass"
+	if r.ActualFailures > r.ExpectedFailures {
+		r.Verdict = "fail"
+	}
+	return &r
+}
+
+// String summarizes the results for the text of a tool result.
+func (r *TestResults) String() string {
+	return fmt.Sprintf("%d tests, %d failed, %d expected to fail: %s", r.Total, r.ActualFailures, r.ExpectedFailures, r.Verdict)
+}
+
+// --- Test Baselines ---
+
+// TestRun is the test results of one build of a port.
+type TestRun struct {
+	Port      string      `json:"port" jsonschema:"name of the port"`
+	Target    string      `json:"target" jsonschema:"target the port was built on"`
+	Directory string      `json:"directory" jsonschema:"directory the port was built in"`
+	Time      time.Time   `json:"time" jsonschema:"when the build finished"`
+	Results   TestResults `json:"results" jsonschema:"the build's test results"`
+}
+
+// TestResultStore keeps the test results of the latest build of each port,
+// in memory, and the baselines they are compared against, one file per port
+// under dir.
+type TestResultStore struct {
+	dir string
+
+	mu     sync.Mutex
+	latest map[string]*TestRun // by target and port
+}
+
+// NewTestResultStore creates a store keeping baselines in dir.
+func NewTestResultStore(dir string) *TestResultStore {
+	return &TestResultStore{dir: dir, latest: make(map[string]*TestRun)}
+}
+
+// defaultBaselineDir returns the per-user directory for test baselines.
+func defaultBaselineDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "zopen-mcp-server", "baselines")
+}
+
+// portName returns the name of the port in directory on target, which is
+// the directory's last path element.
+func portName(target *Target, directory string) string {
+	if !target.Remote {
+		if abs, err := filepath.Abs(directory); err == nil {
+			directory = filepath.ToSlash(abs)
+		}
+	}
+	return path.Base(strings.TrimRight(directory, "/"))
+}
+
+// Record keeps run as the latest test results of its port on its target.
+func (s *TestResultStore) Record(run *TestRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest[run.Target+"/"+run.Port] = run
+}
+
+// Latest returns the latest test results of port on target.
+func (s *TestResultStore) Latest(target, port string) (*TestRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, ok := s.latest[target+"/"+port]
+	return run, ok
+}
+
+// baselineFile returns the file port's baseline is kept in.
+func (s *TestResultStore) baselineFile(port string) (string, error) {
+	if s.dir == "" {
+		return "", fmt.Errorf("no baseline directory configured; set --baseline-dir")
+	}
+	if port == "" || port == "." || port == "/" || strings.ContainsAny(port, `/\`) {
+		return "", validationError("cannot tell the port name from the directory; pass an absolute directory")
+	}
+	return filepath.Join(s.dir, port+".json"), nil
+}
+
+// Baseline returns the stored baseline of port, or nil if it has none.
+func (s *TestResultStore) Baseline(port string) (*TestRun, error) {
+	file, err := s.baselineFile(port)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %w", err)
+	}
+	var run TestRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse baseline %s: %w", file, err)
+	}
+	return &run, nil
+}
+
+// SaveBaseline stores run as the baseline of its port.
+func (s *TestResultStore) SaveBaseline(run *TestRun) error {
+	file, err := s.baselineFile(run.Port)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create baseline directory: %w", err)
+	}
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write and rename, so a crash never leaves a truncated baseline.
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write baseline: %w", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("failed to write baseline: %w", err)
+	}
+	return nil
+}
+
+// --- ZopenCompareTestResults Tool ---
+type ZopenCompareTestResultsParams struct {
+	Directory      string `json:"directory" jsonschema:"the port directory, as passed to zopen_build"`
+	UpdateBaseline bool   `json:"update_baseline,omitempty" jsonschema:"store the latest results as the port's new baseline after comparing"`
+	Target         string `json:"target,omitempty"`
+}
+
+// ZopenCompareTestResultsOutput is the structured result of
+// zopen_compare_test_results.
+type ZopenCompareTestResultsOutput struct {
+	Port            string     `json:"port,omitempty" jsonschema:"name of the port"`
+	Current         *TestRun   `json:"current,omitempty" jsonschema:"test results of the latest build"`
+	Baseline        *TestRun   `json:"baseline,omitempty" jsonschema:"the stored baseline, if there is one"`
+	Verdict         string     `json:"verdict,omitempty" jsonschema:"regressed, improved or unchanged compared to the baseline, or no_baseline; fewer tests run than in the baseline or than the port expects counts as regressed"`
+	FailuresChange  int        `json:"failures_change" jsonschema:"change in failed tests since the baseline"`
+	TotalChange     int        `json:"total_change" jsonschema:"change in tests run since the baseline"`
+	BaselineUpdated bool       `json:"baseline_updated" jsonschema:"whether the latest results were stored as the new baseline"`
+	Error           *ToolError `json:"error,omitempty" jsonschema:"why the call failed"`
+}
+
+// ZopenCompareTestResults compares the test results of the latest zopen_build
+// of a port against the port's stored baseline, and optionally makes them
+// the new baseline.
+func (t *ZopenTools) ZopenCompareTestResults(ctx context.Context, req *mcp.CallToolRequest, args ZopenCompareTestResultsParams) (*mcp.CallToolResult, *ZopenCompareTestResultsOutput, error) {
+	out, err := t.compareTestResults(args)
+	if err != nil {
+		result, _, _ := commandToolResult(ctx, t.Outputs, nil, err)
+		return result, &ZopenCompareTestResultsOutput{Error: newToolError(nil, err)}, nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Port %s on target %s\n", out.Port, out.Current.Target)
+	fmt.Fprintf(&b, "Latest build (%s): %s\n", out.Current.Time.Format(time.RFC3339), &out.Current.Results)
+	if out.Baseline == nil {
+		b.WriteString("No baseline stored for this port.\n")
+	} else {
+		fmt.Fprintf(&b, "Baseline (%s, target %s): %s\n", out.Baseline.Time.Format(time.RFC3339), out.Baseline.Target, &out.Baseline.Results)
+		fmt.Fprintf(&b, "Verdict: %s (failures %+d, tests %+d)\n", out.Verdict, out.FailuresChange, out.TotalChange)
+	}
+	if out.BaselineUpdated {
+		b.WriteString("The latest results are now the baseline.\n")
+	}
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: b.String()}},
+		IsError: false,
+	}, out, nil
+}
+
+func (t *ZopenTools) compareTestResults(args ZopenCompareTestResultsParams) (*ZopenCompareTestResultsOutput, error) {
+	if args.Directory == "" {
+		return nil, validationError("directory parameter is required")
+	}
+	target, err := t.Config.Target(args.Target)
+	if err != nil {
+		return nil, err
+	}
+	port := portName(target, args.Directory)
+	current, ok := t.Tests.Latest(target.Name, port)
+	if !ok {
+		return nil, validationError("no test results recorded for port %s on target %s; run zopen_build on it first", port, target.Name)
+	}
+	baseline, err := t.Tests.Baseline(port)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ZopenCompareTestResultsOutput{Port: port, Current: current, Baseline: baseline, Verdict: "no_baseline"}
+	if baseline != nil {
+		out.FailuresChange = current.Results.ActualFailures - baseline.Results.ActualFailures
+		out.TotalChange = current.Results.Total - baseline.Results.Total
+		switch {
+		// Tests that stopped running cannot fail, so fewer tests run is a
+		// regression even if fewer failed.
+		case out.FailuresChange > 0, out.TotalChange < 0, current.Results.Total < current.Results.ExpectedTotal:
+			out.Verdict = "regressed"
+		case out.FailuresChange < 0:
+			out.Verdict = "improved"
+		default:
+			out.Verdict = "unchanged"
+		}
+	}
+	if args.UpdateBaseline {
+		if err := t.Tests.SaveBaseline(current); err != nil {
+			return nil, err
+		}
+		out.BaselineUpdated = true
+	}
+	return out, nil
+}
@@ -0,0 +1,92 @@
+// testresults_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTestResults(t *testing.T) {
+	got := parseTestResults(readTestdata(t, "build-check.log"))
+	want := &TestResults{Total: 187, ActualFailures: 2, ExpectedFailures: 3, ExpectedTotal: 187, Verdict: "pass"}
+	if got == nil || *got != *want {
+		t.Fatalf("parseTestResults = %+v, want %+v", got, want)
+	}
+
+	// The analysis of the build picks up the same results.
+	if a := analyzeBuildLog(readTestdata(t, "build-check.log"), false); a.Tests == nil || *a.Tests != *want {
+		t.Errorf("build analysis tests = %+v, want %+v", a.Tests, want)
+	}
+
+	got = parseTestResults("actualFailures:5\r\ntotalTests:187\r\nexpectedFailures:3\r\n")
+	if got == nil || got.Verdict != "fail" || got.ExpectedTotal != 0 {
+		t.Errorf("more failures than expected: %+v", got)
+	}
+	if got := parseTestResults(readTestdata(t, "build-compile-error.log")); got != nil {
+		t.Errorf("log without results: %+v", got)
+	}
+}
+
+func TestCompareTestResults(t *testing.T) {
+	baseline := TestResults{Total: 187, ActualFailures: 2, ExpectedFailures: 3, ExpectedTotal: 187}
+	tests := []struct {
+		name    string
+		current TestResults
+		verdict string
+	}{
+		{"unchanged", TestResults{Total: 187, ActualFailures: 2, ExpectedTotal: 187}, "unchanged"},
+		{"more failures", TestResults{Total: 187, ActualFailures: 4, ExpectedTotal: 187}, "regressed"},
+		{"fewer failures", TestResults{Total: 187, ActualFailures: 1, ExpectedTotal: 187}, "improved"},
+		{"more tests", TestResults{Total: 190, ActualFailures: 2, ExpectedTotal: 187}, "unchanged"},
+		{"fewer tests run", TestResults{Total: 120, ActualFailures: 0, ExpectedTotal: 187}, "regressed"},
+		{"fewer tests than expected", TestResults{Total: 187, ActualFailures: 1, ExpectedTotal: 200}, "regressed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := &Target{Name: localTarget}
+			tools := &ZopenTools{
+				Config: &Config{Targets: map[string]*Target{localTarget: local}, DefaultTarget: localTarget},
+				Tests:  NewTestResultStore(t.TempDir()),
+			}
+			run := func(results TestResults) *TestRun {
+				return &TestRun{Port: "m4port", Target: localTarget, Directory: "/dev/m4port", Time: time.Now(), Results: results}
+			}
+			if err := tools.Tests.SaveBaseline(run(baseline)); err != nil {
+				t.Fatal(err)
+			}
+			tools.Tests.Record(run(tt.current))
+
+			out, err := tools.compareTestResults(ZopenCompareTestResultsParams{Directory: "/dev/m4port"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Verdict != tt.verdict {
+				t.Errorf("verdict = %s (failures %+d, tests %+d), want %s", out.Verdict, out.FailuresChange, out.TotalChange, tt.verdict)
+			}
+		})
+	}
+}
+
+func TestCompareTestResultsWithoutBaseline(t *testing.T) {
+	local := &Target{Name: localTarget}
+	tools := &ZopenTools{
+		Config: &Config{Targets: map[string]*Target{localTarget: local}, DefaultTarget: localTarget},
+		Tests:  NewTestResultStore(t.TempDir()),
+	}
+	args := ZopenCompareTestResultsParams{Directory: "/dev/m4port", UpdateBaseline: true}
+	if _, err := tools.compareTestResults(args); err == nil {
+		t.Fatal("compare without recorded results succeeded")
+	}
+
+	tools.Tests.Record(&TestRun{Port: "m4port", Target: localTarget, Results: TestResults{Total: 10}})
+	out, err := tools.compareTestResults(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Verdict != "no_baseline" || !out.BaselineUpdated {
+		t.Errorf("first compare = %+v", out)
+	}
+	if baseline, err := tools.Tests.Baseline("m4port"); err != nil || baseline == nil || baseline.Results.Total != 10 {
+		t.Errorf("stored baseline = %+v, %v", baseline, err)
+	}
+}
@@ -0,0 +1,138 @@
+// timeout.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// --- Timeouts and Cancellation ---
+
+// defaultTimeout applies to tools without a more specific default.
+const defaultTimeout = 10 * time.Minute
+
+// defaultToolTimeouts holds the built-in defaults for tools that routinely
+// run longer than defaultTimeout.
+var defaultToolTimeouts = map[string]time.Duration{
+	"zopen_build":   4 * time.Hour,
+	"zopen_install": time.Hour,
+	"zopen_upgrade": time.Hour,
+
+	"zopen_sandbox_create":  time.Hour,
+	"zopen_sandbox_install": time.Hour,
+}
+
+// ToolTimeout returns how long a call to tool may run. A positive
+// timeout_seconds argument wins, then a --tool-timeout override, then the
+// built-in default for the tool, then --timeout.
+func (c *Config) ToolTimeout(tool string, requestedSeconds int) time.Duration {
+	if requestedSeconds > 0 {
+		return time.Duration(requestedSeconds) * time.Second
+	}
+	if d, ok := c.ToolTimeouts[tool]; ok {
+		return d
+	}
+	if d, ok := defaultToolTimeouts[tool]; ok {
+		return d
+	}
+	if c.DefaultTimeout > 0 {
+		return c.DefaultTimeout
+	}
+	return defaultTimeout
+}
+
+// toolTimeoutFlag parses repeated --tool-timeout name=duration flags.
+type toolTimeoutFlag map[string]time.Duration
+
+func (f toolTimeoutFlag) String() string {
+	var parts []string
+	for name, d := range f {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, d))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f toolTimeoutFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		name, duration, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("expected tool=duration, got %q", item)
+		}
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %v", name, err)
+		}
+		f[strings.TrimSpace(name)] = d
+	}
+	return nil
+}
+
+// addTool registers a tool whose calls are bounded by the tool's timeout.
+// A positive TimeoutSeconds field in the tool's arguments, the
+// timeout_seconds argument, overrides it, so individual handlers don't need
+// to deal with it. The context also records the calling session, which owns
+// the outputs the call stores.
+func addTool[In, Out any](server *mcp.Server, config *Config, tool *mcp.Tool, h mcp.ToolHandlerFor[In, Out]) {
+	mcp.AddTool(server, tool, func(ctx context.Context, req *mcp.CallToolRequest, args In) (*mcp.CallToolResult, Out, error) {
+		ctx, cancel := context.WithTimeout(ctx, config.ToolTimeout(tool.Name, timeoutSeconds(args)))
+		defer cancel()
+		return h(withOutputSession(ctx, req.Session), req, args)
+	})
+}
+
+// timeoutSeconds returns the TimeoutSeconds field of a tool's arguments, or
+// 0 if the tool has none. Each argument struct declares the field itself,
+// since the schema of an embedded struct is not flattened into its parent.
+func timeoutSeconds(args any) int {
+	v := reflect.ValueOf(args)
+	if v.Kind() != reflect.Struct {
+		return 0
+	}
+	if f := v.FieldByName("TimeoutSeconds"); f.IsValid() && f.CanInt() {
+		return int(f.Int())
+	}
+	return 0
+}
+
+// CancelledError reports that a command was stopped before it finished,
+// either because it hit its timeout or because the client cancelled the call.
+type CancelledError struct {
+	Command  string
+	Host     string
+	Elapsed  time.Duration
+	TimedOut bool
+	// KillErr records a failure to terminate the process tree, if any.
+	KillErr error
+}
+
+func (e *CancelledError) Error() string {
+	reason := "was cancelled by the client"
+	if e.TimedOut {
+		reason = "timed out"
+	}
+	msg := fmt.Sprintf("Command '%s' on %s %s after %s and was terminated",
+		e.Command, e.Host, reason, e.Elapsed.Round(time.Millisecond))
+	if e.KillErr != nil {
+		msg += fmt.Sprintf(" (warning: cleanup failed, processes may still be running: %v)", e.KillErr)
+	}
+	return msg
+}
+
+// cancelledError builds the CancelledError for a command stopped by ctx.
+func cancelledError(ctx context.Context, cmd Command, host string, elapsed time.Duration, killErr error) *CancelledError {
+	return &CancelledError{
+		Command:  cmd.String(),
+		Host:     host,
+		Elapsed:  elapsed,
+		TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded),
+		KillErr:  killErr,
+	}
+}
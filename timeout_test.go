@@ -0,0 +1,33 @@
+// timeout_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToolTimeout(t *testing.T) {
+	config := &Config{
+		DefaultTimeout: 3 * time.Minute,
+		ToolTimeouts:   map[string]time.Duration{"zopen_build": 6 * time.Hour},
+	}
+	tests := []struct {
+		tool string
+		args any
+		want time.Duration
+	}{
+		{"zopen_build", ZopenBuildParams{TimeoutSeconds: 90}, 90 * time.Second},
+		{"zopen_build", ZopenBuildParams{}, 6 * time.Hour},
+		{"zopen_install", ZopenInstallParams{}, time.Hour},
+		{"zopen_list", ZopenListParams{TimeoutSeconds: 5}, 5 * time.Second},
+		{"zopen_list", ZopenListParams{TimeoutSeconds: -1}, 3 * time.Minute},
+		{"zopen_version", TargetParams{}, 3 * time.Minute},
+		// Tools without a timeout argument get the configured default.
+		{"zopen_output_read", ZopenOutputReadParams{}, 3 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := config.ToolTimeout(tt.tool, timeoutSeconds(tt.args)); got != tt.want {
+			t.Errorf("%s with %+v: timeout %s, want %s", tt.tool, tt.args, got, tt.want)
+		}
+	}
+}
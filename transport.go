@@ -0,0 +1,157 @@
+// transport.go
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// --- Transports ---
+
+const (
+	transportStdio = "stdio"
+	transportHTTP  = "http"
+
+	// mcpEndpoint is the path the streamable HTTP handler is served on.
+	mcpEndpoint = "/mcp"
+
+	// shutdownTimeout bounds how long in-flight HTTP requests may take to
+	// finish once the server is asked to stop.
+	shutdownTimeout = 10 * time.Second
+
+	// authTokenEnv names the environment variable holding the bearer token
+	// HTTP clients must present. It is read from the environment rather
+	// than a flag so the secret never shows up in the process list.
+	authTokenEnv = "ZOPEN_MCP_AUTH_TOKEN"
+)
+
+// validateTransport checks the transport-related settings in config.
+func validateTransport(config *Config) error {
+	switch config.Transport {
+	case transportStdio:
+		return nil
+	case transportHTTP:
+	default:
+		return fmt.Errorf("--transport must be %q or %q, got %q", transportStdio, transportHTTP, config.Transport)
+	}
+	if config.Listen == "" {
+		return fmt.Errorf("--listen is required when using --transport=http")
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+	// Every client can run commands as the server's SSH user, and on the
+	// local target as the server itself, so only the local machine may
+	// connect unless clients authenticate over TLS.
+	if !config.Insecure && !isLoopback(config.Listen) && (config.TLSCert == "" || config.AuthToken == "") {
+		return fmt.Errorf("--listen %s is not a loopback address: set --tls-cert, --tls-key and %s, or pass --insecure", config.Listen, authTokenEnv)
+	}
+	return nil
+}
+
+// isLoopback reports whether the listen address only accepts connections
+// from the local machine.
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireToken wraps next so that requests without the bearer token are
+// rejected.
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="zopen-mcp-server"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runServer serves the MCP server over the configured transport until the
+// client disconnects (stdio) or the process is interrupted (http).
+func runServer(ctx context.Context, server *mcp.Server, config *Config) error {
+	if config.Transport == transportHTTP {
+		return serveHTTP(ctx, server, config)
+	}
+	return server.Run(ctx, &mcp.StdioTransport{})
+}
+
+// serveHTTP exposes the server with the go-sdk's streamable HTTP handler so
+// several clients can share one instance. Each client gets its own MCP
+// session; all sessions share the server's SSH connections.
+func serveHTTP(ctx context.Context, server *mcp.Server, config *Config) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	handler := mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server {
+		return server
+	}, nil)
+
+	mux := http.NewServeMux()
+	if config.AuthToken != "" {
+		mux.Handle(mcpEndpoint, requireToken(config.AuthToken, handler))
+	} else {
+		mux.Handle(mcpEndpoint, handler)
+	}
+
+	httpServer := &http.Server{
+		Addr:              config.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		scheme := "http"
+		if config.TLSCert != "" {
+			scheme = "https"
+		}
+		log.Printf("Listening for MCP clients on %s://%s%s", scheme, config.Listen, mcpEndpoint)
+
+		var err error
+		if config.TLSCert != "" {
+			err = httpServer.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// transport_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateTransport(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		ok     bool
+	}{
+		{"stdio", Config{Transport: transportStdio}, true},
+		{"localhost", Config{Transport: transportHTTP, Listen: "localhost:8080"}, true},
+		{"loopback IPv4", Config{Transport: transportHTTP, Listen: "127.0.0.1:8080"}, true},
+		{"loopback IPv6", Config{Transport: transportHTTP, Listen: "[::1]:8080"}, true},
+		{"all interfaces", Config{Transport: transportHTTP, Listen: ":8080"}, false},
+		{"public without TLS", Config{Transport: transportHTTP, Listen: "0.0.0.0:8080", AuthToken: "secret"}, false},
+		{"public without token", Config{Transport: transportHTTP, Listen: "0.0.0.0:8080", TLSCert: "c", TLSKey: "k"}, false},
+		{"public with TLS and token", Config{Transport: transportHTTP, Listen: "0.0.0.0:8080", TLSCert: "c", TLSKey: "k", AuthToken: "secret"}, true},
+		{"hostname", Config{Transport: transportHTTP, Listen: "zos-jump.example.com:8080"}, false},
+		{"public insecure", Config{Transport: transportHTTP, Listen: "0.0.0.0:8080", Insecure: true}, true},
+		{"cert without key", Config{Transport: transportHTTP, Listen: "localhost:8080", TLSCert: "c"}, false},
+		{"unknown transport", Config{Transport: "sse"}, false},
+	}
+	for _, tt := range tests {
+		err := validateTransport(&tt.config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: validateTransport = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"Bearer secret", http.StatusNoContent},
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret2", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, mcpEndpoint, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: status %d, want %d", tt.header, rec.Code, tt.want)
+		}
+	}
+}
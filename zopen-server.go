@@ -2,16 +2,14 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
@@ -19,184 +17,162 @@ import (
 // --- Configuration ---
 // Config holds the server's startup configuration, parsed from command-line flags.
 type Config struct {
-	Remote    bool
-	Host      string
-	User      string
-	Key       string
-	Port      int
-	ZopenPath string
+	// Targets are the systems tools can run on, by name. Tools run on
+	// DefaultTarget unless the call names another.
+	Targets       map[string]*Target
+	DefaultTarget string
+
+	// SSHConfigFile is the OpenSSH client config consulted for host
+	// aliases, jump hosts and connection settings.
+	SSHConfigFile string
+
+	// Host key verification
+	KnownHostsFile    string
+	TrustStore        string
+	AcceptNewHostKeys bool
+
+	// MCP transport. HTTP clients must send AuthToken as a bearer token if
+	// it is set; Insecure allows listening on a non-loopback address
+	// without TLS and a token.
+	Transport string
+	Listen    string
+	TLSCert   string
+	TLSKey    string
+	AuthToken string
+	Insecure  bool
+
+	// Timeouts
+	DefaultTimeout time.Duration
+	ToolTimeouts   map[string]time.Duration
+
+	// MaxOutputBytes caps the command output returned inline.
+	MaxOutputBytes int
+
+	// EnvAllowlist holds the patterns of the environment variables tool
+	// calls may set.
+	EnvAllowlist []string
+
+	// Sandboxes are created under SandboxDir on each target and live for
+	// SandboxTTL unless created with another TTL.
+	SandboxDir string
+	SandboxTTL time.Duration
+
+	// BaselineDir holds the test result baselines of ports.
+	BaselineDir string
 }
 
-// --- Command Execution Logic ---
-
-// ZopenExecutor handles the logic of running zopen commands, either locally or via SSH.
-type ZopenExecutor struct {
-	config *Config
-}
+// --- Tool Definitions ---
 
-// ZopenGenerateExecutor handles the logic of running zopen-generate commands.
-type ZopenGenerateExecutor struct {
-	config *Config
+// ZopenTools holds the server configuration and defines the tool methods.
+type ZopenTools struct {
+	Config    *Config
+	Outputs   *OutputStore
+	Sandboxes *SandboxStore
+	Tests     *TestResultStore
 }
 
-// NewZopenExecutor creates a new executor based on the server's configuration.
-func NewZopenExecutor(config *Config) *ZopenExecutor {
-	// Logging disabled to avoid interfering with MCP stdio protocol
-	return &ZopenExecutor{config: config}
-}
+// --- ZopenGenerate Tool Definitions ---
 
-// NewZopenGenerateExecutor creates a new executor based on the server's configuration.
-func NewZopenGenerateExecutor(config *Config) *ZopenGenerateExecutor {
-	// Logging disabled to avoid interfering with MCP stdio protocol
-	return &ZopenGenerateExecutor{config: config}
+// ZopenGenerateTools holds the server configuration and defines the zopen-generate tool methods.
+type ZopenGenerateTools struct {
+	Config  *Config
+	Outputs *OutputStore
 }
 
-// buildSSHCommand constructs the full SSH command for remote execution.
-func (e *ZopenExecutor) buildSSHCommand(zopenArgs []string) []string {
-	sshArgs := []string{"-p", fmt.Sprintf("%d", e.config.Port)}
-	if e.config.Key != "" {
-		sshArgs = append(sshArgs, "-i", e.config.Key)
-	}
-	sshArgs = append(sshArgs,
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-o", "LogLevel=ERROR",
-	)
-
-	target := e.config.Host
-	if e.config.User != "" {
-		target = fmt.Sprintf("%s@%s", e.config.User, e.config.Host)
+// commandToolResult converts the outcome of running a command into a tool
+// result, capping the inline output at the limit of outputs. A failure is
+// returned as an ErrorOutput for the structured content as well as in the
+// text.
+func commandToolResult(ctx context.Context, outputs *OutputStore, res *CommandResult, err error) (*mcp.CallToolResult, any, error) {
+	var output string
+	if err == nil {
+		output = outputs.Limit(ctx, res.Output(), res.Command, res.Host)
 	}
-	sshArgs = append(sshArgs, target)
-
-	// Quote arguments for the remote shell
-	var quotedArgs []string
-	for _, arg := range zopenArgs {
-		quotedArgs = append(quotedArgs, fmt.Sprintf(`"%s"`, arg))
-	}
-
-	innerCommand := fmt.Sprintf(". ~/.profile && zopen %s", strings.Join(quotedArgs, " "))
-	remoteCmd := fmt.Sprintf("/bin/sh -c \"%s\"", innerCommand)
-	sshArgs = append(sshArgs, remoteCmd)
-
-	return append([]string{"ssh"}, sshArgs...)
+	return commandToolResultWithOutput(res, err, output)
 }
 
-// RunCommand executes a zopen command either locally or remotely.
-func (e *ZopenExecutor) RunCommand(ctx context.Context, zopenArgs []string) (string, error) {
-	var commandToRun []string
-	if e.config.Remote {
-		commandToRun = e.buildSSHCommand(zopenArgs)
-	} else {
-		commandToRun = append([]string{"zopen"}, zopenArgs...)
+// commandToolResultWithOutput is commandToolResult with the output to show
+// already chosen.
+func commandToolResultWithOutput(res *CommandResult, err error, output string) (*mcp.CallToolResult, any, error) {
+	toolErr := newToolError(res, err)
+	if err != nil {
+		// Name the kind of failure, so that an unreachable host or rejected
+		// key is not taken for a problem with zopen or the package.
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("❌ Error (%s): %v", toolErr.Code, err)}},
+			IsError: true,
+		}, &ErrorOutput{Error: toolErr}, nil
 	}
 
-	// Log command execution if DEBUG is set
-	if os.Getenv("DEBUG") != "" {
-		log.Printf("Executing: %s", strings.Join(commandToRun, " "))
+	// Say when the output had to be converted, so that garbled text from an
+	// encoding problem is not mistaken for a failure of the tool itself.
+	var note string
+	if res.Conversion != nil {
+		note = fmt.Sprintf("\n\n⚠️ Output encoding: %s.", res.Conversion)
 	}
-	cmd := exec.CommandContext(ctx, commandToRun[0], commandToRun[1:]...)
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	if err != nil {
-		if errors.Is(err, exec.ErrNotFound) {
-			return "", fmt.Errorf("❌ Error: Command '%s' not found. Is it in your PATH?", commandToRun[0])
-		}
-		return fmt.Sprintf("❌ Error (Exit Code: %d):\n%s", cmd.ProcessState.ExitCode(), stderr.String()), nil
+	// Record the variables the call set, since they change what the
+	// command did.
+	if len(res.Env) > 0 {
+		note += fmt.Sprintf("\n\nEnvironment: %s", formatEnv(res.Env))
+	}
+	if toolErr != nil {
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{&mcp.TextContent{
+				Text: fmt.Sprintf("❌ Error (%s, Exit Code: %d):\n%s%s", toolErr.Code, res.ExitCode, output, note),
+			}},
+			IsError: true,
+		}, &ErrorOutput{Error: toolErr}, nil
 	}
 
-	output := stdout.String()
 	if output == "" {
-		return "✅ Command successful with no output.", nil
+		output = "✅ Command successful with no output."
 	}
-	return output, nil
+	output += note
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: output}},
+		IsError: false,
+	}, nil, nil
 }
 
-// RunCommand executes a zopen-generate command with the provided arguments.
-func (e *ZopenGenerateExecutor) RunCommand(ctx context.Context, args []string) (string, error) {
-	// Find zopen-generate in PATH
-	commandPath, err := exec.LookPath("zopen-generate")
-	if err != nil {
-		return "", fmt.Errorf("❌ Error: zopen-generate not found in PATH")
-	}
-
-	// Log command execution if DEBUG is set
-	if os.Getenv("DEBUG") != "" {
-		log.Printf("Executing: %s %s", commandPath, strings.Join(args, " "))
-	}
-	cmd := exec.CommandContext(ctx, commandPath, args...)
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err = cmd.Run()
+// runGenerate runs zopen-generate with args and env in directory on the named target,
+// so on a remote target projects are generated on the z/OS host where
+// zopen_build will look for them.
+func (t *ZopenGenerateTools) runGenerate(ctx context.Context, targetName string, env map[string]string, directory string, args []string) (*CommandResult, error) {
+	target, err := t.Config.Target(targetName)
 	if err != nil {
-		if errors.Is(err, exec.ErrNotFound) {
-			return "", fmt.Errorf("❌ Error: Command '%s' not found", commandPath)
-		}
-		// Return stderr as part of the output, not as an error
-		return fmt.Sprintf("❌ Error (Exit Code: %d):\n%s\n%s",
-			cmd.ProcessState.ExitCode(),
-			stderr.String(),
-			stdout.String()), nil
+		return nil, err
 	}
-
-	output := stdout.String()
-	if stderr.Len() > 0 {
-		output = fmt.Sprintf("%s\n%s", output, stderr.String())
+	if err := t.Config.CheckEnv(env); err != nil {
+		return nil, err
 	}
-	
-	if output == "" {
-		return "✅ Command successful with no output.", nil
-	}
-	return output, nil
-}
-
-// --- Tool Definitions ---
-
-// ZopenTools holds the server configuration and defines the tool methods.
-type ZopenTools struct {
-	Config *Config
-}
-
-// --- ZopenGenerate Tool Definitions ---
-
-// ZopenGenerateTools holds the server configuration and defines the zopen-generate tool methods.
-type ZopenGenerateTools struct {
-	Config *Config
+	return target.Exec.Run(ctx, Command{Program: target.ZopenGenerateBinary(), Args: args, Dir: directory, Env: env})
 }
 
 // --- ZopenGenerate Tool ---
 type ZopenGenerateParams struct {
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Categories  string   `json:"categories"`
-	License     string   `json:"license"`
-	Type        string   `json:"type,omitempty"`
-	BuildSystem string   `json:"build_system,omitempty"`
-	StableUrl   string   `json:"stable_url,omitempty"`
-	StableDeps  string   `json:"stable_deps,omitempty"`
-	DevUrl      string   `json:"dev_url,omitempty"`
-	DevDeps     string   `json:"dev_deps,omitempty"`
-	BuildLine   string   `json:"build_line,omitempty"`
-	RuntimeDeps string   `json:"runtime_deps,omitempty"`
-	Force       bool     `json:"force,omitempty"`
+	Name           string            `json:"name"`
+	Description    string            `json:"description"`
+	Categories     string            `json:"categories"`
+	License        string            `json:"license"`
+	Type           string            `json:"type,omitempty"`
+	BuildSystem    string            `json:"build_system,omitempty"`
+	StableUrl      string            `json:"stable_url,omitempty"`
+	StableDeps     string            `json:"stable_deps,omitempty"`
+	DevUrl         string            `json:"dev_url,omitempty"`
+	DevDeps        string            `json:"dev_deps,omitempty"`
+	BuildLine      string            `json:"build_line,omitempty"`
+	RuntimeDeps    string            `json:"runtime_deps,omitempty"`
+	Force          bool              `json:"force,omitempty"`
+	Directory      string            `json:"directory,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
 func (t *ZopenGenerateTools) ZopenGenerate(ctx context.Context, req *mcp.CallToolRequest, args ZopenGenerateParams) (*mcp.CallToolResult, any, error) {
 	// Validate required parameters
 	if args.Name == "" || args.Description == "" || args.Categories == "" || args.License == "" {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{
-				Text: "❌ Error: Required parameters missing. name, description, categories, and license are required.",
-			}},
-			IsError: true,
-		}, nil, nil
+		return commandToolResult(ctx, t.Outputs, nil, validationError("required parameters missing: name, description, categories and license are required"))
 	}
 
 	// Build command arguments
@@ -237,87 +213,200 @@ func (t *ZopenGenerateTools) ZopenGenerate(ctx context.Context, req *mcp.CallToo
 		cmdArgs = append(cmdArgs, "--force")
 	}
 
-	executor := NewZopenGenerateExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, cmdArgs)
+	res, err := t.runGenerate(ctx, args.Target, args.Env, args.Directory, cmdArgs)
+	return commandToolResult(ctx, t.Outputs, res, err)
+}
+
+// --- ZopenGenerateHelp Tool ---
+func (t *ZopenGenerateTools) ZopenGenerateHelp(ctx context.Context, req *mcp.CallToolRequest, args TargetParams) (*mcp.CallToolResult, any, error) {
+	res, err := t.runGenerate(ctx, args.Target, args.Env, "", []string{"--help"})
+	return commandToolResult(ctx, t.Outputs, res, err)
+}
+
+// --- ZopenGenerateVersion Tool ---
+func (t *ZopenGenerateTools) ZopenGenerateVersion(ctx context.Context, req *mcp.CallToolRequest, args TargetParams) (*mcp.CallToolResult, any, error) {
+	res, err := t.runGenerate(ctx, args.Target, args.Env, "", []string{"--version"})
+	return commandToolResult(ctx, t.Outputs, res, err)
+}
+
+// runZopen runs zopen with zopenArgs and env in directory on target. An
+// empty directory runs the command in the executor's default directory.
+// Each line of output is passed to onLine as it arrives; onLine may be nil.
+func (t *ZopenTools) runZopen(ctx context.Context, target *Target, env map[string]string, directory string, zopenArgs []string, onLine func(line string, stderr bool)) (*CommandResult, error) {
+	if err := t.Config.CheckEnv(env); err != nil {
+		return nil, err
+	}
+	cmd := Command{Program: target.ZopenBinary(), Args: zopenArgs, Dir: directory, Env: env, OnLine: onLine}
+	return target.Exec.Run(ctx, cmd)
+}
+
+// Generic handler for zopen commands, run with env on the named target or
+// the default target if targetName is empty.
+func (t *ZopenTools) handleZopenCommand(ctx context.Context, targetName string, env map[string]string, zopenArgs []string) (*mcp.CallToolResult, any, error) {
+	target, err := t.Config.Target(targetName)
 	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}},
-			IsError: true,
-		}, nil, nil
+		return commandToolResult(ctx, t.Outputs, nil, err)
 	}
+	res, err := t.runZopen(ctx, target, env, "", zopenArgs, nil)
+	return commandToolResult(ctx, t.Outputs, res, err)
+}
 
-	isError := strings.HasPrefix(output, "❌")
-	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: output}},
-		IsError: isError,
-	}, nil, nil
+// handleReadOnlyCommand is handleZopenCommand for commands that change
+// nothing on the target, which are retried if the connection fails.
+func (t *ZopenTools) handleReadOnlyCommand(ctx context.Context, targetName string, env map[string]string, zopenArgs []string) (*mcp.CallToolResult, any, error) {
+	res, err := t.runReadOnlyCommand(ctx, targetName, env, zopenArgs)
+	return commandToolResult(ctx, t.Outputs, res, err)
 }
 
-// --- ZopenGenerateHelp Tool ---
-func (t *ZopenGenerateTools) ZopenGenerateHelp(ctx context.Context, req *mcp.CallToolRequest, args any) (*mcp.CallToolResult, any, error) {
-	executor := NewZopenGenerateExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, []string{"--help"})
+// runReadOnlyCommand runs a zopen command that changes nothing on the named
+// target, retrying it if the connection fails.
+func (t *ZopenTools) runReadOnlyCommand(ctx context.Context, targetName string, env map[string]string, zopenArgs []string) (*CommandResult, error) {
+	target, err := t.Config.Target(targetName)
 	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}},
-			IsError: true,
-		}, nil, nil
+		return nil, err
 	}
-
-	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: output}},
-		IsError: false,
-	}, nil, nil
+	if err := t.Config.CheckEnv(env); err != nil {
+		return nil, err
+	}
+	res, err := runReadOnly(ctx, target, Command{Program: target.ZopenBinary(), Args: zopenArgs, Env: env})
+	markPackageCommand(res, zopenArgs)
+	return res, err
 }
 
-// --- ZopenGenerateVersion Tool ---
-func (t *ZopenGenerateTools) ZopenGenerateVersion(ctx context.Context, req *mcp.CallToolRequest, args any) (*mcp.CallToolResult, any, error) {
-	executor := NewZopenGenerateExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, []string{"--version"})
+// handleMutatingCommand is handleZopenCommand for commands that change the
+// target. They run one at a time per target, in the order they were called,
+// and are retried while another zopen process holds the lock. Output is
+// streamed as progress notifications when the client asked for them.
+func (t *ZopenTools) handleMutatingCommand(ctx context.Context, req *mcp.CallToolRequest, targetName string, env map[string]string, zopenArgs []string) (*mcp.CallToolResult, any, error) {
+	target, err := t.Config.Target(targetName)
 	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}},
-			IsError: true,
-		}, nil, nil
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	if err := t.Config.CheckEnv(env); err != nil {
+		return commandToolResult(ctx, t.Outputs, nil, err)
+	}
+	progress := NewProgressReporter(ctx, req)
+	cmd := Command{Program: target.ZopenBinary(), Args: zopenArgs, Env: env}
+	if progress != nil {
+		cmd.OnLine = progress.Line
 	}
+	res, err := runMutating(ctx, target, cmd, progress)
+	return commandToolResult(ctx, t.Outputs, res, err)
+}
 
-	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: output}},
-		IsError: false,
-	}, nil, nil
+// ZopenChangeOutput is the structured result of the tools that install,
+// remove, upgrade or switch packages.
+type ZopenChangeOutput struct {
+	Changes *PackageDiff `json:"changes,omitempty" jsonschema:"what the call changed in the installed packages; missing if they could not be listed before and after the call"`
+	Error   *ToolError   `json:"error,omitempty" jsonschema:"why the call failed"`
 }
 
-// Generic handler for zopen commands
-func (t *ZopenTools) handleZopenCommand(ctx context.Context, zopenArgs []string) (*mcp.CallToolResult, any, error) {
-	executor := NewZopenExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, zopenArgs)
+// handlePackageChange is handleMutatingCommand for commands that install,
+// remove, upgrade or switch packages. It also returns what the command
+// changed in the installed packages, which is reported even when the
+// command failed part way through.
+func (t *ZopenTools) handlePackageChange(ctx context.Context, req *mcp.CallToolRequest, targetName string, env map[string]string, zopenArgs []string) (*mcp.CallToolResult, *ZopenChangeOutput, error) {
+	res, changes, err := t.runPackageChange(ctx, req, targetName, env, zopenArgs)
+	result, _, _ := commandToolResult(ctx, t.Outputs, res, err)
+	if changes != nil {
+		text := result.Content[0].(*mcp.TextContent)
+		text.Text += fmt.Sprintf("\n\nPackage changes: %s", changes)
+	}
+	return result, &ZopenChangeOutput{Changes: changes, Error: newToolError(res, err)}, nil
+}
+
+// runPackageChange runs a zopen command that changes the installed packages
+// on the named target, listing them before and after it while holding the
+// target's queue, so the difference is the command's alone. The difference
+// is nil if either listing failed.
+func (t *ZopenTools) runPackageChange(ctx context.Context, req *mcp.CallToolRequest, targetName string, env map[string]string, zopenArgs []string) (*CommandResult, *PackageDiff, error) {
+	target, err := t.Config.Target(targetName)
 	if err != nil {
-		return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}}, IsError: true}, nil, nil
+		return nil, nil, err
+	}
+	if err := t.Config.CheckEnv(env); err != nil {
+		return nil, nil, err
 	}
-	isError := strings.HasPrefix(output, "❌")
-	return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: output}}, IsError: isError}, nil, nil
+	progress := NewProgressReporter(ctx, req)
+	cmd := Command{Program: target.ZopenBinary(), Args: zopenArgs, Env: env}
+	if progress != nil {
+		cmd.OnLine = progress.Line
+	}
+	release, err := acquireTarget(ctx, target, cmd, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	before, err := snapshotPackages(ctx, target, env)
+	if err != nil {
+		log.Printf("Warning: target %s: failed to list packages before %s, changes will not be reported: %v", target.Name, cmd, err)
+	}
+	res, err := runRetryingLock(ctx, target, cmd, progress)
+	markPackageCommand(res, zopenArgs)
+	if before == nil {
+		return res, nil, err
+	}
+	after, snapshotErr := snapshotPackages(ctx, target, env)
+	if snapshotErr != nil {
+		log.Printf("Warning: target %s: failed to list packages after %s, changes will not be reported: %v", target.Name, cmd, snapshotErr)
+		return res, nil, err
+	}
+	// zopen alt changes which installed version is active.
+	return res, diffPackages(before, after, zopenArgs[0] == "alt"), err
 }
 
 // --- ZopenList Tool ---
 type ZopenListParams struct {
-	Verbose bool `json:"verbose"`
+	Verbose        bool              `json:"verbose"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
-func (t *ZopenTools) ZopenList(ctx context.Context, req *mcp.CallToolRequest, args ZopenListParams) (*mcp.CallToolResult, any, error) {
+// ZopenListOutput is the structured result of zopen_list.
+type ZopenListOutput struct {
+	Packages []PackageRecord `json:"packages" jsonschema:"the packages listed by zopen list"`
+	Error    *ToolError      `json:"error,omitempty" jsonschema:"why the call failed"`
+}
+
+// ZopenList returns the packages as structured content as well as the text
+// zopen printed. The structured list is complete even when the text is
+// truncated.
+func (t *ZopenTools) ZopenList(ctx context.Context, req *mcp.CallToolRequest, args ZopenListParams) (*mcp.CallToolResult, *ZopenListOutput, error) {
 	zopenArgs := []string{"list"}
 	if args.Verbose {
 		zopenArgs = append(zopenArgs, "--verbose")
 	}
-	return t.handleZopenCommand(ctx, zopenArgs)
+	res, err := t.runReadOnlyCommand(ctx, args.Target, args.Env, zopenArgs)
+	result, _, _ := commandToolResult(ctx, t.Outputs, res, err)
+	out := &ZopenListOutput{Packages: []PackageRecord{}, Error: newToolError(res, err)}
+	if err == nil && res.ExitCode == 0 {
+		if packages := parsePackageTable(res.Stdout); packages != nil {
+			out.Packages = packages
+		}
+	}
+	return result, out, nil
 }
 
 // --- ZopenQuery Tool ---
 type ZopenQueryParams struct {
-	Packages []string `json:"packages"`
-	Verbose  bool     `json:"verbose"`
+	Packages       []string          `json:"packages"`
+	Verbose        bool              `json:"verbose"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+// ZopenQueryOutput is the structured result of zopen_query.
+type ZopenQueryOutput struct {
+	Packages []PackageQueryRecord `json:"packages" jsonschema:"one record per requested package, or every package zopen listed if none were requested"`
+	Error    *ToolError           `json:"error,omitempty" jsonschema:"why the call failed"`
 }
 
-func (t *ZopenTools) ZopenQuery(ctx context.Context, req *mcp.CallToolRequest, args ZopenQueryParams) (*mcp.CallToolResult, any, error) {
+// ZopenQuery returns one record per requested package as structured content,
+// including a not-found record for each package zopen did not list.
+func (t *ZopenTools) ZopenQuery(ctx context.Context, req *mcp.CallToolRequest, args ZopenQueryParams) (*mcp.CallToolResult, *ZopenQueryOutput, error) {
 	zopenArgs := []string{"query"}
 	if args.Verbose {
 		zopenArgs = append(zopenArgs, "--verbose")
@@ -325,47 +414,67 @@ func (t *ZopenTools) ZopenQuery(ctx context.Context, req *mcp.CallToolRequest, a
 	if len(args.Packages) > 0 {
 		zopenArgs = append(zopenArgs, args.Packages...)
 	}
-	return t.handleZopenCommand(ctx, zopenArgs)
+	res, err := t.runReadOnlyCommand(ctx, args.Target, args.Env, zopenArgs)
+	result, _, _ := commandToolResult(ctx, t.Outputs, res, err)
+	out := &ZopenQueryOutput{Packages: []PackageQueryRecord{}, Error: newToolError(res, err)}
+	if err == nil {
+		// zopen query fails when a package is not found but still lists
+		// the others, so a table is used whatever the exit code.
+		found := parsePackageTable(res.Stdout)
+		if found != nil || res.ExitCode == 0 {
+			out.Packages = queryRecords(args.Packages, found)
+		}
+	}
+	return result, out, nil
 }
 
 // --- ZopenInstall Tool ---
 type ZopenInstallParams struct {
-	Packages []string `json:"packages"`
-	Verbose  bool     `json:"verbose"`
+	Packages       []string          `json:"packages"`
+	Verbose        bool              `json:"verbose"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
-func (t *ZopenTools) ZopenInstall(ctx context.Context, req *mcp.CallToolRequest, args ZopenInstallParams) (*mcp.CallToolResult, any, error) {
+func (t *ZopenTools) ZopenInstall(ctx context.Context, req *mcp.CallToolRequest, args ZopenInstallParams) (*mcp.CallToolResult, *ZopenChangeOutput, error) {
 	zopenArgs := []string{"install"}
 	if args.Verbose {
 		zopenArgs = append(zopenArgs, "--verbose")
 	}
 	zopenArgs = append(zopenArgs, args.Packages...)
-	return t.handleZopenCommand(ctx, zopenArgs)
+	return t.handlePackageChange(ctx, req, args.Target, args.Env, zopenArgs)
 }
 
 // --- ZopenRemove Tool ---
 type ZopenRemoveParams struct {
-	Packages []string `json:"packages"`
-	Verbose  bool     `json:"verbose"`
+	Packages       []string          `json:"packages"`
+	Verbose        bool              `json:"verbose"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
-func (t *ZopenTools) ZopenRemove(ctx context.Context, req *mcp.CallToolRequest, args ZopenRemoveParams) (*mcp.CallToolResult, any, error) {
+func (t *ZopenTools) ZopenRemove(ctx context.Context, req *mcp.CallToolRequest, args ZopenRemoveParams) (*mcp.CallToolResult, *ZopenChangeOutput, error) {
 	zopenArgs := []string{"remove"}
 	if args.Verbose {
 		zopenArgs = append(zopenArgs, "--verbose")
 	}
 	zopenArgs = append(zopenArgs, args.Packages...)
-	return t.handleZopenCommand(ctx, zopenArgs)
+	return t.handlePackageChange(ctx, req, args.Target, args.Env, zopenArgs)
 }
 
 // --- ZopenUpgrade Tool ---
 type ZopenUpgradeParams struct {
-	Packages []string `json:"packages"`
-	Verbose  bool     `json:"verbose"`
-	Yes      bool     `json:"yes"`
+	Packages       []string          `json:"packages"`
+	Verbose        bool              `json:"verbose"`
+	Yes            bool              `json:"yes"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
-func (t *ZopenTools) ZopenUpgrade(ctx context.Context, req *mcp.CallToolRequest, args ZopenUpgradeParams) (*mcp.CallToolResult, any, error) {
+func (t *ZopenTools) ZopenUpgrade(ctx context.Context, req *mcp.CallToolRequest, args ZopenUpgradeParams) (*mcp.CallToolResult, *ZopenChangeOutput, error) {
 	zopenArgs := []string{"upgrade"}
 	if args.Yes {
 		zopenArgs = append(zopenArgs, "--yes")
@@ -376,39 +485,54 @@ func (t *ZopenTools) ZopenUpgrade(ctx context.Context, req *mcp.CallToolRequest,
 	if len(args.Packages) > 0 {
 		zopenArgs = append(zopenArgs, args.Packages...)
 	}
-	return t.handleZopenCommand(ctx, zopenArgs)
+	return t.handlePackageChange(ctx, req, args.Target, args.Env, zopenArgs)
 }
 
 // --- ZopenInfo Tool ---
 type ZopenInfoParams struct {
-	Package string `json:"package"`
-	Verbose bool   `json:"verbose"`
+	Package        string            `json:"package"`
+	Verbose        bool              `json:"verbose"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
-func (t *ZopenTools) ZopenInfo(ctx context.Context, req *mcp.CallToolRequest, args ZopenInfoParams) (*mcp.CallToolResult, any, error) {
+// ZopenInfo returns the package's details as structured content as well as
+// the text zopen printed.
+func (t *ZopenTools) ZopenInfo(ctx context.Context, req *mcp.CallToolRequest, args ZopenInfoParams) (*mcp.CallToolResult, *PackageInfo, error) {
 	zopenArgs := []string{"info", args.Package}
 	if args.Verbose {
 		zopenArgs = append(zopenArgs, "--verbose")
 	}
-	return t.handleZopenCommand(ctx, zopenArgs)
+	res, err := t.runReadOnlyCommand(ctx, args.Target, args.Env, zopenArgs)
+	result, _, _ := commandToolResult(ctx, t.Outputs, res, err)
+	out := &PackageInfo{Name: args.Package, Dependencies: []string{}}
+	if err == nil && res.ExitCode == 0 {
+		out = parsePackageInfo(args.Package, res.Stdout)
+	}
+	out.Error = newToolError(res, err)
+	return result, out, nil
 }
 
 // --- ZopenVersion Tool ---
-func (t *ZopenTools) ZopenVersion(ctx context.Context, req *mcp.CallToolRequest, args any) (*mcp.CallToolResult, any, error) {
-	return t.handleZopenCommand(ctx, []string{"version"})
+func (t *ZopenTools) ZopenVersion(ctx context.Context, req *mcp.CallToolRequest, args TargetParams) (*mcp.CallToolResult, any, error) {
+	return t.handleReadOnlyCommand(ctx, args.Target, args.Env, []string{"version"})
 }
 
 // --- ZopenInit Tool ---
-func (t *ZopenTools) ZopenInit(ctx context.Context, req *mcp.CallToolRequest, args any) (*mcp.CallToolResult, any, error) {
-	return t.handleZopenCommand(ctx, []string{"init"})
+func (t *ZopenTools) ZopenInit(ctx context.Context, req *mcp.CallToolRequest, args TargetParams) (*mcp.CallToolResult, any, error) {
+	return t.handleMutatingCommand(ctx, req, args.Target, args.Env, []string{"init"})
 }
 
 // --- ZopenClean Tool ---
 type ZopenCleanParams struct {
-	Cache    bool `json:"cache"`
-	Unused   bool `json:"unused"`
-	Dangling bool `json:"dangling"`
-	All      bool `json:"all"`
+	Cache          bool              `json:"cache"`
+	Unused         bool              `json:"unused"`
+	Dangling       bool              `json:"dangling"`
+	All            bool              `json:"all"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
 func (t *ZopenTools) ZopenClean(ctx context.Context, req *mcp.CallToolRequest, args ZopenCleanParams) (*mcp.CallToolResult, any, error) {
@@ -425,41 +549,104 @@ func (t *ZopenTools) ZopenClean(ctx context.Context, req *mcp.CallToolRequest, a
 	if args.All {
 		zopenArgs = append(zopenArgs, "--all")
 	}
-	return t.handleZopenCommand(ctx, zopenArgs)
+	return t.handleMutatingCommand(ctx, req, args.Target, args.Env, zopenArgs)
 }
 
 // --- ZopenAlt Tool ---
 type ZopenAltParams struct {
-	Package string `json:"package"`
-	Switch  string `json:"switch"`
+	Package        string            `json:"package"`
+	Switch         string            `json:"switch"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
-func (t *ZopenTools) ZopenAlt(ctx context.Context, req *mcp.CallToolRequest, args ZopenAltParams) (*mcp.CallToolResult, any, error) {
+func (t *ZopenTools) ZopenAlt(ctx context.Context, req *mcp.CallToolRequest, args ZopenAltParams) (*mcp.CallToolResult, *ZopenChangeOutput, error) {
 	zopenArgs := []string{"alt"}
 	if args.Package != "" {
 		zopenArgs = append(zopenArgs, args.Package)
 	}
-	if args.Switch != "" {
-		zopenArgs = append(zopenArgs, "-s", args.Switch)
+	if args.Switch == "" {
+		// Without a switch, zopen alt only lists the versions.
+		res, err := t.runReadOnlyCommand(ctx, args.Target, args.Env, zopenArgs)
+		result, _, _ := commandToolResult(ctx, t.Outputs, res, err)
+		return result, &ZopenChangeOutput{Error: newToolError(res, err)}, nil
 	}
-	return t.handleZopenCommand(ctx, zopenArgs)
+	zopenArgs = append(zopenArgs, "-s", args.Switch)
+	return t.handlePackageChange(ctx, req, args.Target, args.Env, zopenArgs)
 }
 
 // --- ZopenBuild Tool ---
 type ZopenBuildParams struct {
-	Directory string `json:"directory"`
-	Verbose   bool   `json:"verbose"`
-	Force     bool   `json:"force"`
+	Directory      string            `json:"directory"`
+	Verbose        bool              `json:"verbose"`
+	Force          bool              `json:"force"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+// ZopenBuildOutput is the structured result of zopen_build.
+type ZopenBuildOutput struct {
+	Analysis *BuildAnalysis `json:"analysis,omitempty" jsonschema:"the build's phases and, if it failed, where and why; for a build that timed out or was cancelled, of the output up to then; missing if the build did not run"`
+	Error    *ToolError     `json:"error,omitempty" jsonschema:"why the call failed"`
+}
+
+// ZopenBuild returns an analysis of the build log as structured content. When
+// the build fails, the text shows what went wrong and the end of the log of
+// the phase that failed instead of the whole log. Test results are kept for
+// zopen_compare_test_results.
+func (t *ZopenTools) ZopenBuild(ctx context.Context, req *mcp.CallToolRequest, args ZopenBuildParams) (*mcp.CallToolResult, *ZopenBuildOutput, error) {
+	record := &buildLog{progress: NewProgressReporter(ctx, req)}
+	res, err := t.runBuild(ctx, args, record)
+	out := &ZopenBuildOutput{Error: newToolError(res, err)}
+	if err != nil {
+		// A build stopped part way still shows how far it got and the
+		// errors it hit before then.
+		if text := record.String(); text != "" {
+			out.Analysis = analyzeBuildLog(text, true)
+		}
+		result, _, _ := commandToolResult(ctx, t.Outputs, nil, err)
+		return result, out, nil
+	}
+
+	// The recorded log keeps stdout and stderr in the order they were
+	// written; fall back to the result for executors that do not stream.
+	text := record.String()
+	if text == "" {
+		text = res.Output()
+	}
+	out.Analysis = analyzeBuildLog(text, res.ExitCode != 0)
+	if tests := out.Analysis.Tests; tests != nil {
+		if target, err := t.Config.Target(args.Target); err == nil {
+			t.Tests.Record(&TestRun{
+				Port:      portName(target, args.Directory),
+				Target:    target.Name,
+				Directory: args.Directory,
+				Time:      time.Now(),
+				Results:   *tests,
+			})
+		}
+	}
+	if res.ExitCode == 0 {
+		result, _, _ := commandToolResult(ctx, t.Outputs, res, nil)
+		if tests := out.Analysis.Tests; tests != nil {
+			text := result.Content[0].(*mcp.TextContent)
+			text.Text += fmt.Sprintf("\n\nTest results: %s", tests)
+		}
+		return result, out, nil
+	}
+	excerpt, first, last := out.Analysis.Excerpt(text)
+	output := out.Analysis.Summary() + "\n" + t.Outputs.Excerpt(ctx, text, excerpt, first, last, res.Command, res.Host)
+	result, _, _ := commandToolResultWithOutput(res, nil, output)
+	return result, out, nil
 }
 
-func (t *ZopenTools) ZopenBuild(ctx context.Context, req *mcp.CallToolRequest, args ZopenBuildParams) (*mcp.CallToolResult, any, error) {
+// runBuild runs zopen build as described by args, recording its output in
+// record.
+func (t *ZopenTools) runBuild(ctx context.Context, args ZopenBuildParams, record *buildLog) (*CommandResult, error) {
 	if args.Directory == "" {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{
-				Text: "❌ Error: directory parameter is required",
-			}},
-			IsError: true,
-		}, nil, nil
+		return nil, validationError("directory parameter is required")
 	}
 
 	// Build the command
@@ -471,159 +658,49 @@ func (t *ZopenTools) ZopenBuild(ctx context.Context, req *mcp.CallToolRequest, a
 		zopenArgs = append(zopenArgs, "-f")
 	}
 
-	// For local execution, we need to cd into the directory
-	if !t.Config.Remote {
+	target, err := t.Config.Target(args.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	directory := args.Directory
+
+	// For local execution, resolve and check the directory up front
+	if !target.Remote {
 		// Get absolute path
 		absPath, err := filepath.Abs(args.Directory)
 		if err != nil {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{
-					Text: fmt.Sprintf("❌ Error: failed to get absolute path: %v", err),
-				}},
-				IsError: true,
-			}, nil, nil
+			return nil, fmt.Errorf("failed to get absolute path: %v", err)
 		}
 
 		// Check if directory exists
 		if _, err := os.Stat(absPath); os.IsNotExist(err) {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{
-					Text: fmt.Sprintf("❌ Error: directory does not exist: %s", absPath),
-				}},
-				IsError: true,
-			}, nil, nil
-		}
-
-		// Execute in the directory
-		cmd := exec.CommandContext(ctx, "zopen", zopenArgs...)
-		cmd.Dir = absPath
-
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		err = cmd.Run()
-		output := stdout.String()
-		if stderr.Len() > 0 {
-			output = fmt.Sprintf("%s\n%s", output, stderr.String())
+			return nil, validationError("directory does not exist: %s", absPath)
 		}
-
-		if err != nil {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{
-					Text: fmt.Sprintf("❌ Error (Exit Code: %d):\n%s", cmd.ProcessState.ExitCode(), output),
-				}},
-				IsError: true,
-			}, nil, nil
-		}
-
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: output}},
-			IsError: false,
-		}, nil, nil
+		directory = absPath
 	}
 
-	// For remote execution, cd into directory before running zopen build
-	return t.handleZopenCommandInDirectory(ctx, args.Directory, zopenArgs)
-}
-
-// handleZopenCommandInDirectory is similar to handleZopenCommand but changes directory first
-func (t *ZopenTools) handleZopenCommandInDirectory(ctx context.Context, directory string, zopenArgs []string) (*mcp.CallToolResult, any, error) {
-	executor := NewZopenExecutor(t.Config)
-
-	if t.Config.Remote {
-		// For remote, we need to modify the SSH command to cd first
-		sshArgs := []string{"-p", fmt.Sprintf("%d", t.Config.Port)}
-		if t.Config.Key != "" {
-			sshArgs = append(sshArgs, "-i", t.Config.Key)
-		}
-		sshArgs = append(sshArgs,
-			"-o", "StrictHostKeyChecking=no",
-			"-o", "UserKnownHostsFile=/dev/null",
-			"-o", "LogLevel=ERROR",
-		)
-
-		target := t.Config.Host
-		if t.Config.User != "" {
-			target = fmt.Sprintf("%s@%s", t.Config.User, t.Config.Host)
-		}
-		sshArgs = append(sshArgs, target)
-
-		// Quote arguments for the remote shell
-		var quotedArgs []string
-		for _, arg := range zopenArgs {
-			quotedArgs = append(quotedArgs, fmt.Sprintf(`"%s"`, arg))
-		}
-
-		innerCommand := fmt.Sprintf(". ~/.profile && cd %s && zopen %s", directory, strings.Join(quotedArgs, " "))
-		remoteCmd := fmt.Sprintf("/bin/sh -c \"%s\"", innerCommand)
-		sshArgs = append(sshArgs, remoteCmd)
-
-		commandToRun := append([]string{"ssh"}, sshArgs...)
-		// Logging disabled for MCP stdio protocol
-	// log.Printf("Executing: %s", strings.Join(commandToRun, " "))
-
-		cmd := exec.CommandContext(ctx, commandToRun[0], commandToRun[1:]...)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		err := cmd.Run()
-		if err != nil {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{
-					Text: fmt.Sprintf("❌ Error (Exit Code: %d):\n%s", cmd.ProcessState.ExitCode(), stderr.String()),
-				}},
-				IsError: true,
-			}, nil, nil
-		}
-
-		output := stdout.String()
-		if output == "" {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{Text: "✅ Command successful with no output."}},
-				IsError: false,
-			}, nil, nil
-		}
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: output}},
-			IsError: false,
-		}, nil, nil
-	}
-
-	output, err := executor.RunCommand(ctx, zopenArgs)
-	if err != nil {
-		return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}}, IsError: true}, nil, nil
-	}
-	isError := strings.HasPrefix(output, "❌")
-	return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: output}}, IsError: isError}, nil, nil
+	return t.runZopen(ctx, target, args.Env, directory, zopenArgs, record.Line)
 }
 
 // --- ZopenBuildHelp Tool ---
-func (t *ZopenTools) ZopenBuildHelp(ctx context.Context, req *mcp.CallToolRequest, args any) (*mcp.CallToolResult, any, error) {
-	executor := NewZopenExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, []string{"build", "--help"})
-	if err != nil {
-		return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}}, IsError: true}, nil, nil
-	}
-	return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: output}}, IsError: false}, nil, nil
+func (t *ZopenTools) ZopenBuildHelp(ctx context.Context, req *mcp.CallToolRequest, args TargetParams) (*mcp.CallToolResult, any, error) {
+	return t.handleZopenCommand(ctx, args.Target, args.Env, []string{"build", "--help"})
 }
 
 // --- ZopenCreateRepo Tool ---
 type ZopenCreateRepoParams struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	User        string `json:"user"`
+	Name           string            `json:"name"`
+	Description    string            `json:"description"`
+	User           string            `json:"user"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
 func (t *ZopenTools) ZopenCreateRepo(ctx context.Context, req *mcp.CallToolRequest, args ZopenCreateRepoParams) (*mcp.CallToolResult, any, error) {
 	if args.Name == "" {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{
-				Text: "❌ Error: name parameter is required",
-			}},
-			IsError: true,
-		}, nil, nil
+		return commandToolResult(ctx, t.Outputs, nil, validationError("name parameter is required"))
 	}
 
 	// Build the command
@@ -637,31 +714,23 @@ func (t *ZopenTools) ZopenCreateRepo(ctx context.Context, req *mcp.CallToolReque
 		zopenArgs = append(zopenArgs, "-u", args.User)
 	}
 
-	executor := NewZopenExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, zopenArgs)
-	if err != nil {
-		return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}}, IsError: true}, nil, nil
-	}
-	isError := strings.HasPrefix(output, "❌")
-	return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: output}}, IsError: isError}, nil, nil
+	return t.handleZopenCommand(ctx, args.Target, args.Env, zopenArgs)
 }
 
 // --- ZopenCreateCicdJob Tool ---
 type ZopenCreateCicdJobParams struct {
-	Name       string `json:"name"`
-	BuildType  string `json:"build_type"`
-	ScriptName string `json:"script_name"`
-	RunAfter   string `json:"run_after"`
+	Name           string            `json:"name"`
+	BuildType      string            `json:"build_type"`
+	ScriptName     string            `json:"script_name"`
+	RunAfter       string            `json:"run_after"`
+	Env            map[string]string `json:"env,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
 }
 
 func (t *ZopenTools) ZopenCreateCicdJob(ctx context.Context, req *mcp.CallToolRequest, args ZopenCreateCicdJobParams) (*mcp.CallToolResult, any, error) {
 	if args.Name == "" {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{
-				Text: "❌ Error: name parameter is required",
-			}},
-			IsError: true,
-		}, nil, nil
+		return commandToolResult(ctx, t.Outputs, nil, validationError("name parameter is required"))
 	}
 
 	// Build the command
@@ -679,155 +748,205 @@ func (t *ZopenTools) ZopenCreateCicdJob(ctx context.Context, req *mcp.CallToolRe
 		zopenArgs = append(zopenArgs, "-r", args.RunAfter)
 	}
 
-	executor := NewZopenExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, zopenArgs)
-	if err != nil {
-		return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}}, IsError: true}, nil, nil
-	}
-	isError := strings.HasPrefix(output, "❌")
-	return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: output}}, IsError: isError}, nil, nil
+	return t.handleZopenCommand(ctx, args.Target, args.Env, zopenArgs)
 }
 
 // --- ZopenGenerateListLicenses Tool ---
-func (t *ZopenGenerateTools) ZopenGenerateListLicenses(ctx context.Context, req *mcp.CallToolRequest, args any) (*mcp.CallToolResult, any, error) {
-	executor := NewZopenGenerateExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, []string{"--json", "--list-licenses"})
-	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}},
-			IsError: true,
-		}, nil, nil
-	}
-
-	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: output}},
-		IsError: false,
-	}, nil, nil
+func (t *ZopenGenerateTools) ZopenGenerateListLicenses(ctx context.Context, req *mcp.CallToolRequest, args TargetParams) (*mcp.CallToolResult, any, error) {
+	res, err := t.runGenerate(ctx, args.Target, args.Env, "", []string{"--json", "--list-licenses"})
+	return commandToolResult(ctx, t.Outputs, res, err)
 }
 
 // --- ZopenGenerateListCategories Tool ---
-func (t *ZopenGenerateTools) ZopenGenerateListCategories(ctx context.Context, req *mcp.CallToolRequest, args any) (*mcp.CallToolResult, any, error) {
-	executor := NewZopenGenerateExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, []string{"--json", "--list-categories"})
-	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}},
-			IsError: true,
-		}, nil, nil
-	}
-
-	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: output}},
-		IsError: false,
-	}, nil, nil
+func (t *ZopenGenerateTools) ZopenGenerateListCategories(ctx context.Context, req *mcp.CallToolRequest, args TargetParams) (*mcp.CallToolResult, any, error) {
+	res, err := t.runGenerate(ctx, args.Target, args.Env, "", []string{"--json", "--list-categories"})
+	return commandToolResult(ctx, t.Outputs, res, err)
 }
 
 // --- ZopenGenerateListBuildSystems Tool ---
-func (t *ZopenGenerateTools) ZopenGenerateListBuildSystems(ctx context.Context, req *mcp.CallToolRequest, args any) (*mcp.CallToolResult, any, error) {
-	executor := NewZopenGenerateExecutor(t.Config)
-	output, err := executor.RunCommand(ctx, []string{"--json", "--list-build-systems"})
-	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}},
-			IsError: true,
-		}, nil, nil
-	}
-
-	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: output}},
-		IsError: false,
-	}, nil, nil
+func (t *ZopenGenerateTools) ZopenGenerateListBuildSystems(ctx context.Context, req *mcp.CallToolRequest, args TargetParams) (*mcp.CallToolResult, any, error) {
+	res, err := t.runGenerate(ctx, args.Target, args.Env, "", []string{"--json", "--list-build-systems"})
+	return commandToolResult(ctx, t.Outputs, res, err)
 }
 
 // --- Main Server ---
 
 func main() {
-	config := &Config{}
-	flag.BoolVar(&config.Remote, "remote", false, "Run in remote mode. Requires SSH details.")
-	flag.StringVar(&config.Host, "host", "", "Remote z/OS hostname or IP (required for remote mode)")
-	flag.StringVar(&config.User, "user", "", "SSH username for the remote system")
-	flag.StringVar(&config.Key, "key", "", "Path to the SSH private key file")
-	flag.IntVar(&config.Port, "port", 22, "SSH port number (default: 22)")
-	flag.StringVar(&config.ZopenPath, "zopen-path", "", "Path to the zopen executable (optional, will use PATH if not specified)")
+	config := &Config{Targets: make(map[string]*Target)}
+	// Settings can also come from a config file and ZOPEN_MCP_* variables;
+	// see loadConfig.
+	flag.String("config", "", "YAML or JSON config file with targets and settings (env: ZOPEN_MCP_CONFIG)")
+	flag.String("profile", "", "Profile in the config file to apply on top of its base settings (env: ZOPEN_MCP_PROFILE)")
+	// The --remote flags describe one remote target, named after its host,
+	// and act as defaults for the settings of targets given with --target.
+	var remote bool
+	defaults := &Target{}
+	flag.BoolVar(&remote, "remote", false, "Run in remote mode. Requires SSH details.")
+	flag.StringVar(&defaults.Host, "host", "", "Remote z/OS hostname or IP (required for remote mode)")
+	flag.StringVar(&defaults.User, "user", "", "SSH username for the remote system")
+	flag.StringVar(&defaults.Key, "key", "", "Path to the SSH private key file")
+	flag.IntVar(&defaults.Port, "port", 0, "SSH port number (default: 22, or the Port from ssh_config)")
+	flag.StringVar(&defaults.ZopenPath, "zopen-path", "", "Path to the zopen executable (optional, will use PATH if not specified)")
+	flag.StringVar(&defaults.ZopenGeneratePath, "zopen-generate-path", "", "Path to the zopen-generate executable (optional, will use PATH if not specified)")
+	flag.StringVar(&defaults.Codepage, "codepage", codepageAuto, "Encoding of remote output: auto, IBM-1047, IBM-037, IBM-1140, ISO8859-1 or UTF-8 (no conversion)")
+	flag.StringVar(&defaults.Bootstrap, "bootstrap", bootstrapAuto, "Remote environment setup: auto (zopen-config if found, else ~/.profile), none, profile[:path] or zopen-config[:path]")
+	flag.Var(targetFlag(config.Targets), "target", "Named target as name=local or name=[user@]host[:port][,key=...,codepage=...,bootstrap=...,proxy-jump=...,proxy-command=...,connect-timeout=...,keepalive=...,host-key-fingerprint=...,zopen-path=...,zopen-generate-path=...] (repeatable)")
+	flag.StringVar(&config.DefaultTarget, "default-target", "", "Target tools run on when a call does not name one (default: the --remote host, else local)")
+	flag.StringVar(&defaults.ProxyJump, "proxy-jump", "", "Comma-separated jump hosts to connect through, as [user@]host[:port] (like ssh -J)")
+	flag.StringVar(&defaults.ProxyCommand, "proxy-command", "", "Local command to connect through, with %h, %p and %r expanded (like ssh ProxyCommand)")
+	flag.DurationVar(&defaults.ConnectTimeout, "connect-timeout", 0, "Timeout for connecting to each SSH host (default: 30s)")
+	flag.DurationVar(&defaults.KeepAlive, "keepalive", 0, "Interval between SSH keepalive requests (default: 1m)")
+	flag.StringVar(&config.SSHConfigFile, "ssh-config", defaultSSHConfigFile(), "OpenSSH client config file for host aliases, jump hosts and connection settings (empty to disable)")
+	flag.StringVar(&config.KnownHostsFile, "known-hosts", defaultKnownHostsFile(), "known_hosts file used to verify the remote host key")
+	flag.StringVar(&config.TrustStore, "trust-store", defaultTrustStore(), "File where host keys accepted on first use are pinned")
+	flag.StringVar(&defaults.HostKeyFingerprint, "host-key-fingerprint", "", "Expected SHA256 fingerprint of the remote host key (e.g. SHA256:abc...)")
+	flag.BoolVar(&config.AcceptNewHostKeys, "accept-new-host-keys", true, "Trust and pin the key of a host seen for the first time")
+	flag.StringVar(&config.Transport, "transport", transportStdio, "MCP transport: stdio or http")
+	flag.StringVar(&config.Listen, "listen", "localhost:8080", "Address to listen on when using --transport=http")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "TLS certificate file for --transport=http (enables HTTPS)")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "TLS private key file for --transport=http")
+	flag.BoolVar(&config.Insecure, "insecure", false, "Allow --transport=http on a non-loopback address without TLS and "+authTokenEnv)
+	flag.DurationVar(&config.DefaultTimeout, "timeout", defaultTimeout, "Default timeout for tool calls")
+	config.ToolTimeouts = make(map[string]time.Duration)
+	config.EnvAllowlist = defaultEnvAllowlist
+	flag.Var(&envAllowFlag{list: &config.EnvAllowlist}, "env-allow", "Environment variables tool calls may set with the env argument, comma-separated, with * wildcards (repeatable; replaces the default list of ZOPEN_ROOT, ZOPEN_BUILD_LINE, compiler and proxy variables)")
+	flag.StringVar(&config.SandboxDir, "sandbox-dir", defaultSandboxDir, "Directory on each target in which zopen_sandbox_create creates sandbox zopen roots")
+	flag.DurationVar(&config.SandboxTTL, "sandbox-ttl", defaultSandboxTTL, "How long a sandbox lives before it is removed, unless created with ttl_minutes")
+	flag.StringVar(&config.BaselineDir, "baseline-dir", defaultBaselineDir(), "Directory where zopen_compare_test_results stores the test result baselines of ports")
+	flag.IntVar(&config.MaxOutputBytes, "max-output-bytes", defaultMaxOutputBytes, "Maximum command output returned inline; larger output is truncated and can be paged with zopen_output_read (0 disables)")
+	flag.Var(toolTimeoutFlag(config.ToolTimeouts), "tool-timeout", "Per-tool timeout override as tool=duration (repeatable, e.g. zopen_build=6h)")
 	flag.Parse()
 
-	if config.Remote && config.Host == "" {
-		fmt.Println("Error: --host is required when using --remote mode.")
+	// Errors go to stderr: with --transport=stdio, stdout carries the MCP
+	// protocol.
+	if err := loadConfig(flag.CommandLine, os.Args[1:], config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if remote && defaults.Host == "" {
+		fmt.Fprintln(os.Stderr, "Error: --host is required when using --remote mode.")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if err := setupTargets(config, defaults, remote); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	config.AuthToken = os.Getenv(authTokenEnv)
+	if err := validateTransport(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	server := mcp.NewServer(&mcp.Implementation{
 		Name:    "Zopen Tools Server (Go)",
 		Version: "1.0.0",
 	}, nil)
 
-	tools := &ZopenTools{Config: config}
-	genTools := &ZopenGenerateTools{Config: config}
+	sshPool := NewSSHPool(config)
+	defer sshPool.Close()
+
+	// Targets on the same host share a queue, since they share its zopen
+	// installation.
+	queues := make(map[string]*TargetQueue)
+	for _, target := range config.Targets {
+		host := localHost
+		if target.Remote {
+			host = sshAddr(target)
+		}
+		if queues[host] == nil {
+			queues[host] = &TargetQueue{}
+		}
+		target.Queue = queues[host]
+		if target.Remote {
+			target.Exec = NewSSHExecutor(target, sshPool)
+		} else {
+			target.Exec = &LocalExecutor{}
+		}
+	}
+
+	if err := resolveBinaries(context.Background(), config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	outputs := NewOutputStore(config.MaxOutputBytes)
+	sandboxes := NewSandboxStore(config.SandboxDir, config.SandboxTTL)
+	go sandboxes.Start(context.Background())
+	tools := &ZopenTools{Config: config, Outputs: outputs, Sandboxes: sandboxes, Tests: NewTestResultStore(config.BaselineDir)}
+	genTools := &ZopenGenerateTools{Config: config, Outputs: outputs}
 
 	// Register each tool individually
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_list", Description: "Lists information about zopen community packages"}, tools.ZopenList)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_query", Description: "List local or remote info about zopen community packages"}, tools.ZopenQuery)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_install", Description: "Installs one or more zopen community packages"}, tools.ZopenInstall)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_remove", Description: "Removes installed zopen community packages"}, tools.ZopenRemove)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_upgrade", Description: "Upgrades existing zopen community packages"}, tools.ZopenUpgrade)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_info", Description: "Displays detailed information about a package"}, tools.ZopenInfo)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_version", Description: "Display the installed zopen version"}, tools.ZopenVersion)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_init", Description: "Initializes the zopen environment"}, tools.ZopenInit)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_clean", Description: "Removes unused resources"}, tools.ZopenClean)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_alt", Description: "Switch between different versions of a package"}, tools.ZopenAlt)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_build", Description: "Build a zopen project in the specified directory"}, tools.ZopenBuild)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_build_help", Description: "Display help information for zopen build"}, tools.ZopenBuildHelp)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_create_repo", Description: "Create a new port repository in zopencommunity (core contributors only)"}, tools.ZopenCreateRepo)
-	mcp.AddTool(server, &mcp.Tool{Name: "zopen_create_cicd_job", Description: "Create a Jenkins CI/CD job for a port (core contributors only)"}, tools.ZopenCreateCicdJob)
+	addTool(server, config, &mcp.Tool{Name: "zopen_list", Description: "Lists information about zopen community packages, returning each package's installed and latest version and release line as structured content"}, tools.ZopenList)
+	addTool(server, config, &mcp.Tool{Name: "zopen_query", Description: "List local or remote info about zopen community packages, returning a record per requested package, with not-found entries for unknown names, as structured content"}, tools.ZopenQuery)
+	addTool(server, config, &mcp.Tool{Name: "zopen_install", Description: "Installs one or more zopen community packages"}, tools.ZopenInstall)
+	addTool(server, config, &mcp.Tool{Name: "zopen_remove", Description: "Removes installed zopen community packages"}, tools.ZopenRemove)
+	addTool(server, config, &mcp.Tool{Name: "zopen_upgrade", Description: "Upgrades existing zopen community packages"}, tools.ZopenUpgrade)
+	addTool(server, config, &mcp.Tool{Name: "zopen_info", Description: "Displays detailed information about a package, returning its version, release, dependencies, install path, size, license and repository URL as structured content"}, tools.ZopenInfo)
+	addTool(server, config, &mcp.Tool{Name: "zopen_version", Description: "Display the installed zopen version"}, tools.ZopenVersion)
+	addTool(server, config, &mcp.Tool{Name: "zopen_init", Description: "Initializes the zopen environment"}, tools.ZopenInit)
+	addTool(server, config, &mcp.Tool{Name: "zopen_clean", Description: "Removes unused resources"}, tools.ZopenClean)
+	addTool(server, config, &mcp.Tool{Name: "zopen_alt", Description: "Switch between different versions of a package"}, tools.ZopenAlt)
+	addTool(server, config, &mcp.Tool{Name: "zopen_build", Description: "Build a zopen project in the specified directory, returning the build's phases, the failing phase, compiler and linker errors, failed patch hunks and test results as structured content"}, tools.ZopenBuild)
+	addTool(server, config, &mcp.Tool{Name: "zopen_build_help", Description: "Display help information for zopen build"}, tools.ZopenBuildHelp)
+	addTool(server, config, &mcp.Tool{Name: "zopen_compare_test_results", Description: "Compare the test results of the latest zopen_build of a port against the port's stored baseline, optionally making them the new baseline"}, tools.ZopenCompareTestResults)
+	addTool(server, config, &mcp.Tool{Name: "zopen_create_repo", Description: "Create a new port repository in zopencommunity (core contributors only)"}, tools.ZopenCreateRepo)
+	addTool(server, config, &mcp.Tool{Name: "zopen_env", Description: "Show the effective environment zopen runs in on a target (PATH, ZOPEN_ROOT, _BPXK_AUTOCVT, ...) and how it is set up"}, tools.ZopenEnv)
+	addTool(server, config, &mcp.Tool{Name: "zopen_list_targets", Description: "List the systems tools can run on; pass one as the target argument of any zopen tool"}, tools.ZopenListTargets)
+	addTool(server, config, &mcp.Tool{Name: "zopen_output_read", Description: "Page through the full output of a command whose result was truncated, by byte offset or line number"}, tools.ZopenOutputRead)
+	addTool(server, config, &mcp.Tool{Name: "zopen_sandbox_create", Description: "Create a throwaway zopen root on a target for trying packages without touching the shared zopen install; it is removed when its TTL expires"}, tools.ZopenSandboxCreate)
+	addTool(server, config, &mcp.Tool{Name: "zopen_sandbox_install", Description: "Install zopen community packages into a sandbox"}, tools.ZopenSandboxInstall)
+	addTool(server, config, &mcp.Tool{Name: "zopen_sandbox_run", Description: "Run a shell command with a sandbox's zopen environment active"}, tools.ZopenSandboxRun)
+	addTool(server, config, &mcp.Tool{Name: "zopen_sandbox_destroy", Description: "Remove a sandbox and everything installed in it"}, tools.ZopenSandboxDestroy)
+	addTool(server, config, &mcp.Tool{Name: "zopen_sandbox_list", Description: "List the sandboxes created by this server"}, tools.ZopenSandboxList)
+	addTool(server, config, &mcp.Tool{Name: "zopen_create_cicd_job", Description: "Create a Jenkins CI/CD job for a port (core contributors only)"}, tools.ZopenCreateCicdJob)
 
 	// Register zopen-generate tools
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, config, &mcp.Tool{
 		Name:        "zopen_generate",
-		Description: "Generate a zopen compatible project with customizable parameters",
+		Description: "Generate a zopen compatible project with customizable parameters. On a remote target the project is generated on the z/OS host, in the optional directory",
 	}, genTools.ZopenGenerate)
 
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, config, &mcp.Tool{
 		Name:        "zopen_generate_help",
 		Description: "Display help information for zopen-generate",
 	}, genTools.ZopenGenerateHelp)
 
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, config, &mcp.Tool{
 		Name:        "zopen_generate_version",
 		Description: "Display version information for zopen-generate",
 	}, genTools.ZopenGenerateVersion)
 
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, config, &mcp.Tool{
 		Name:        "zopen_generate_list_licenses",
 		Description: "List all valid license identifiers (returns JSON)",
 	}, genTools.ZopenGenerateListLicenses)
 
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, config, &mcp.Tool{
 		Name:        "zopen_generate_list_categories",
 		Description: "List all valid project categories (returns JSON)",
 	}, genTools.ZopenGenerateListCategories)
 
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, config, &mcp.Tool{
 		Name:        "zopen_generate_list_build_systems",
 		Description: "List all valid build systems (returns JSON)",
 	}, genTools.ZopenGenerateListBuildSystems)
 
-	mode := "LOCAL"
-	if config.Remote {
-		mode = "REMOTE"
-	}
-
 	// Only log startup in debug mode (avoid interfering with MCP protocol)
 	// MCP uses stdio for communication, so we minimize logging
 	if os.Getenv("DEBUG") != "" {
-		log.Printf("Starting Zopen MCP server in %s mode...", mode)
+		log.Printf("Starting Zopen MCP server with targets %s (default %s) over %s...",
+			strings.Join(config.TargetNames(), ", "), config.DefaultTarget, config.Transport)
 	}
 
 	ctx := context.Background()
-	if err := server.Run(ctx, &mcp.StdioTransport{}); err != nil {
-		// Log to stderr is OK, but only in debug mode
-		if os.Getenv("DEBUG") != "" {
+	if err := runServer(ctx, server, config); err != nil {
+		// Log to stderr is OK, but only in debug mode or when stdio
+		// is not carrying the protocol
+		if os.Getenv("DEBUG") != "" || config.Transport == transportHTTP {
 			log.Fatalf("Server exited with error: %v", err)
 		}
 		os.Exit(1)